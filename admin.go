@@ -0,0 +1,222 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// admin.go contains the Caddy admin API endpoints for inspecting Tailscale nodes.
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminNodesEndpoint is the base path of the Tailscale admin API endpoints.
+const adminNodesEndpoint = "/tailscale/nodes"
+
+// adminAPI is a module that serves endpoints to inspect the Tailscale nodes
+// that are currently in use by Caddy.
+//
+//   - GET /tailscale/nodes lists all nodes
+//   - GET /tailscale/nodes/<name>/status returns the full Tailscale status of a node
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.tailscale",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes for the Tailscale nodes.
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminNodesEndpoint,
+			Handler: caddy.AdminHandlerFunc(a.handleNodes),
+		},
+		{
+			Pattern: adminNodesEndpoint + "/",
+			Handler: caddy.AdminHandlerFunc(a.handleNodes),
+		},
+	}
+}
+
+// adminNodeInfo is the summary of a node returned by the admin API.
+type adminNodeInfo struct {
+	// Name is the name of the node in the Caddy config.
+	Name string `json:"name"`
+
+	// Hostname is the hostname the node registers with.
+	Hostname string `json:"hostname"`
+
+	// Started is true once the node has been started.
+	// Nodes are started when they are first used, such as when listening on the node.
+	Started bool `json:"started"`
+
+	// BackendState is the state of the node's Tailscale backend, such as "Running" or "NeedsLogin".
+	BackendState string `json:"backend_state,omitempty"`
+
+	// AuthURL is the URL to visit to authenticate the node, if it needs to be logged in interactively.
+	AuthURL string `json:"auth_url,omitempty"`
+
+	// TailscaleIPs are the Tailscale IP addresses of the node.
+	TailscaleIPs []netip.Addr `json:"tailscale_ips,omitempty"`
+
+	// CertDomains are the domains the node can get TLS certificates for.
+	CertDomains []string `json:"cert_domains,omitempty"`
+
+	// Listeners are the keys of the listeners open on the node.
+	Listeners []string `json:"listeners,omitempty"`
+
+	// References is the number of references to the node held by Caddy modules.
+	References int `json:"references"`
+}
+
+// handleNodes routes API requests within adminNodesEndpoint.
+func (a *adminAPI) handleNodes(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	uri := strings.Trim(strings.TrimPrefix(r.URL.Path, adminNodesEndpoint), "/")
+	parts := strings.Split(uri, "/")
+	switch {
+	case uri == "":
+		return a.handleListNodes(w, r)
+	case len(parts) == 2 && parts[0] != "" && parts[1] == "status":
+		return a.handleNodeStatus(w, r, parts[0])
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("resource not found: %v", r.URL.Path),
+	}
+}
+
+// handleListNodes returns a summary of all nodes in use.
+// Nodes that have not been started are listed, but not started.
+func (a *adminAPI) handleListNodes(w http.ResponseWriter, r *http.Request) error {
+	listeners := make(map[string][]string)
+	tailscaleListeners.Range(func(key, value any) bool {
+		var node string
+		switch ln := value.(type) {
+		case *tailscaleSharedListener:
+			node = ln.node
+		case *tailscaleSharedPacketConn:
+			node = ln.node
+		}
+		listeners[node] = append(listeners[node], key.(string))
+		return true
+	})
+
+	infos := []adminNodeInfo{}
+	for name, node := range poolNodes() {
+		refs, _ := nodes.References(name)
+		info := adminNodeInfo{
+			Name:       name,
+			Hostname:   node.Hostname,
+			Started:    node.started(),
+			Listeners:  listeners[name],
+			References: refs,
+		}
+		slices.Sort(info.Listeners)
+		if info.Started {
+			if lc, err := node.LocalClient(); err == nil {
+				if st, err := lc.StatusWithoutPeers(r.Context()); err == nil {
+					info.BackendState = st.BackendState
+					info.AuthURL = st.AuthURL
+				}
+			}
+			ip4, ip6 := node.TailscaleIPs()
+			for _, ip := range []netip.Addr{ip4, ip6} {
+				if ip.IsValid() {
+					info.TailscaleIPs = append(info.TailscaleIPs, ip)
+				}
+			}
+			info.CertDomains = node.CertDomains()
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b adminNodeInfo) int { return cmp.Compare(a.Name, b.Name) })
+
+	return writeAdminJSON(w, infos)
+}
+
+// handleNodeStatus returns the full Tailscale status of the named node, including its peers.
+func (a *adminAPI) handleNodeStatus(w http.ResponseWriter, r *http.Request, name string) error {
+	node, ok := poolNodes()[name]
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("node not found: %s", name),
+		}
+	}
+	if !node.started() {
+		return caddy.APIError{
+			HTTPStatus: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("node not started: %s", name),
+		}
+	}
+
+	lc, err := node.LocalClient()
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	st, err := lc.Status(r.Context())
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadGateway,
+			Err:        fmt.Errorf("getting status of node %s: %v", name, err),
+		}
+	}
+
+	return writeAdminJSON(w, st)
+}
+
+// poolNodes returns a snapshot of the nodes in the usage pool by name.
+// The pool is locked while ranging, so nodes must not be accessed from within Range.
+func poolNodes() map[string]*tailscaleNode {
+	m := make(map[string]*tailscaleNode)
+	nodes.Range(func(key, value any) bool {
+		if node, ok := value.(*tailscaleNode); ok {
+			m[key.(string)] = node
+		}
+		return true
+	})
+	return m
+}
+
+// writeAdminJSON writes v to w as a JSON admin API response.
+func writeAdminJSON(w http.ResponseWriter, v any) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(encoded)
+	return nil
+}
+
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,89 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/util/must"
+)
+
+func Test_AdminAPI(t *testing.T) {
+	must.Do(caddy.Run(new(caddy.Config)))
+	ctx := caddy.ActiveContext()
+
+	node := must.Get(getNode(ctx, "adminnode"))
+	defer nodes.Delete("adminnode")
+	ln := must.Get(net.Listen("tcp", "127.0.0.1:0"))
+	tailscaleListeners.LoadOrStore("tailscale/adminnode:tcp:80", &tailscaleSharedListener{Listener: ln, key: "tailscale/adminnode:tcp:80", node: "adminnode"})
+	defer tailscaleListeners.Delete("tailscale/adminnode:tcp:80")
+
+	a := new(adminAPI)
+
+	t.Run("list nodes", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/tailscale/nodes", nil)
+		if err := a.handleNodes(w, r); err != nil {
+			t.Fatal(err)
+		}
+		var got []adminNodeInfo
+		must.Do(json.Unmarshal(w.Body.Bytes(), &got))
+		want := []adminNodeInfo{{
+			Name:       "adminnode",
+			Hostname:   node.Hostname,
+			Listeners:  []string{"tailscale/adminnode:tcp:80"},
+			References: 1,
+		}}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("list nodes diff(-got +want):\n%s", diff)
+		}
+	})
+
+	tests := map[string]struct {
+		method     string
+		path       string
+		wantStatus int
+	}{
+		"status of unstarted node": {
+			method:     http.MethodGet,
+			path:       "/tailscale/nodes/adminnode/status",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		"status of unknown node": {
+			method:     http.MethodGet,
+			path:       "/tailscale/nodes/unknown/status",
+			wantStatus: http.StatusNotFound,
+		},
+		"unknown resource": {
+			method:     http.MethodGet,
+			path:       "/tailscale/nodes/adminnode/foo",
+			wantStatus: http.StatusNotFound,
+		},
+		"method not allowed": {
+			method:     http.MethodPost,
+			path:       "/tailscale/nodes",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			err := a.handleNodes(httptest.NewRecorder(), r)
+			var apiErr caddy.APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("handleNodes() error = %v, want APIError", err)
+			}
+			if apiErr.HTTPStatus != tt.wantStatus {
+				t.Errorf("handleNodes() status = %d, want %d", apiErr.HTTPStatus, tt.wantStatus)
+			}
+		})
+	}
+}
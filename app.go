@@ -6,6 +6,11 @@ package tscaddy
 // app.go contains App and Node, which provide global configuration for registering Tailscale nodes.
 
 import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
 	"strconv"
 
 	"github.com/caddyserver/caddy/v2"
@@ -28,6 +33,17 @@ type App struct {
 	// DefaultAuthKey is the default auth key to use for Tailscale if no other auth key is specified.
 	DefaultAuthKey string `json:"auth_key,omitempty" caddy:"namespace=tailscale.auth_key"`
 
+	// AuthKeyFile is the path to a file containing the default auth key.
+	AuthKeyFile string `json:"auth_key_file,omitempty" caddy:"namespace=tailscale.auth_key_file"`
+
+	// OAuthClientID is the ID of the default OAuth client used to mint auth keys.
+	OAuthClientID string `json:"oauth_client_id,omitempty" caddy:"namespace=tailscale.oauth_client_id"`
+
+	// OAuthClientSecret is the secret of the default OAuth client used to mint auth keys.
+	// If set, a new pre-authorized auth key is created when a node is first registered.
+	// Tags must also be configured.
+	OAuthClientSecret string `json:"oauth_client_secret,omitempty" caddy:"namespace=tailscale.oauth_client_secret"`
+
 	// ControlURL specifies the default control URL to use for nodes.
 	ControlURL string `json:"control_url,omitempty" caddy:"namespace=tailscale.control_url"`
 
@@ -38,16 +54,57 @@ type App struct {
 	// Each node will have a subdirectory under this parent directory for its state.
 	StateDir string `json:"state_dir,omitempty" caddy:"namespace=tailscale.state_dir"`
 
+	// StateStore specifies where nodes store their Tailscale state:
+	// "file" (the default) to store it in the state directory,
+	// or "caddy_storage" to store it in Caddy's configured storage module.
+	// Nodes using Caddy storage are locked while running,
+	// so that Caddy instances sharing the storage never run the same node concurrently.
+	StateStore string `json:"state_store,omitempty" caddy:"namespace=tailscale.state_store"`
+
 	// WebUI specifies whether Tailscale nodes should run the Web UI for remote management.
 	WebUI bool `json:"webui,omitempty" caddy:"namespace=tailscale.webui"`
 
 	// Tags to apply to all nodes when registered.
 	Tags []string `json:"tags,omitempty" caddy:"namespace=tailscale.tags"`
 
+	// LoginTimeout specifies how long to wait for nodes to log in when they are first used.
+	// If a node is not running within this time, such as when it needs to be authenticated
+	// interactively, the Caddy config fails to load.
+	// If zero, nodes are not waited for.
+	LoginTimeout caddy.Duration `json:"login_timeout,omitempty" caddy:"namespace=tailscale.login_timeout"`
+
+	// WaitForRunning specifies whether listeners on Tailscale nodes should wait for the node to be running
+	// before they are created. If a node is not running within StartupTimeout,
+	// such as when its auth key is invalid or the control server is unreachable,
+	// the Caddy config fails to load.
+	WaitForRunning bool `json:"wait_for_running,omitempty" caddy:"namespace=tailscale.wait_for_running"`
+
+	// StartupTimeout specifies how long to wait for nodes to be running when WaitForRunning is set.
+	// Defaults to 1 minute.
+	StartupTimeout caddy.Duration `json:"startup_timeout,omitempty" caddy:"namespace=tailscale.startup_timeout"`
+
+	// AdvertiseRoutes are the subnet routes that nodes advertise to the tailnet.
+	// Routes must be approved in the tailnet before they are used.
+	AdvertiseRoutes []netip.Prefix `json:"advertise_routes,omitempty" caddy:"namespace=tailscale.advertise_routes"`
+
+	// AdvertiseExitNode specifies whether nodes advertise themselves as exit nodes.
+	AdvertiseExitNode bool `json:"advertise_exit_node,omitempty" caddy:"namespace=tailscale.advertise_exit_node"`
+
+	// AcceptRoutes specifies whether nodes accept subnet routes advertised by other nodes,
+	// such as to reach proxy backends behind a subnet router.
+	// If unset, the Tailscale default is used.
+	AcceptRoutes opt.Bool `json:"accept_routes,omitempty" caddy:"namespace=tailscale.accept_routes"`
+
+	// AcceptDNS specifies whether nodes use the tailnet's DNS configuration.
+	// If unset, the Tailscale default is used.
+	AcceptDNS opt.Bool `json:"accept_dns,omitempty" caddy:"namespace=tailscale.accept_dns"`
+
 	// Nodes is a map of per-node configuration which overrides global options.
 	Nodes map[string]Node `json:"nodes,omitempty" caddy:"namespace=tailscale"`
 
-	logger *zap.Logger
+	logger  *zap.Logger
+	ctx     caddy.Context
+	proxies []*nodeProxy
 }
 
 // Node is a Tailscale node configuration.
@@ -57,6 +114,17 @@ type Node struct {
 	// AuthKey is the Tailscale auth key used to register the node.
 	AuthKey string `json:"auth_key,omitempty" caddy:"namespace=auth_key"`
 
+	// AuthKeyFile is the path to a file containing the auth key used to register the node.
+	AuthKeyFile string `json:"auth_key_file,omitempty" caddy:"namespace=tailscale.auth_key_file"`
+
+	// OAuthClientID is the ID of the OAuth client used to mint an auth key for the node.
+	OAuthClientID string `json:"oauth_client_id,omitempty" caddy:"namespace=tailscale.oauth_client_id"`
+
+	// OAuthClientSecret is the secret of the OAuth client used to mint an auth key for the node.
+	// If set, a new pre-authorized auth key is created when the node is first registered.
+	// Tags must also be configured.
+	OAuthClientSecret string `json:"oauth_client_secret,omitempty" caddy:"namespace=tailscale.oauth_client_secret"`
+
 	// ControlURL specifies the control URL to use for the node.
 	ControlURL string `json:"control_url,omitempty" caddy:"namespace=tailscale.control_url"`
 
@@ -66,9 +134,64 @@ type Node struct {
 	// WebUI specifies whether the node should run the Web UI for remote management.
 	WebUI opt.Bool `json:"webui,omitempty" caddy:"namespace=tailscale.webui"`
 
+	// Funnel specifies whether listeners on the node should also accept connections
+	// from the public internet with Tailscale Funnel.
+	// Funnel is only used for TCP listeners on ports 443, 8443, and 10000,
+	// and must be allowed for the node in the tailnet policy file.
+	Funnel bool `json:"funnel,omitempty" caddy:"namespace=tailscale.funnel"`
+
+	// AdvertiseServices are the Tailscale Services the node hosts, such as "svc:web".
+	// The "svc:" prefix may be omitted. Listeners on the "tailscale-svc" network for these
+	// services use this node. The services are advertised when the node starts,
+	// along with any others it listens on.
+	// Service hosts must be tagged, and the services must be defined in the tailnet.
+	AdvertiseServices []string `json:"advertise_services,omitempty" caddy:"namespace=tailscale.advertise_services"`
+
+	// AdvertiseRoutes are the subnet routes that the node advertises to the tailnet.
+	// Overrides the global routes.
+	AdvertiseRoutes []netip.Prefix `json:"advertise_routes,omitempty" caddy:"namespace=tailscale.advertise_routes"`
+
+	// AdvertiseExitNode specifies whether the node advertises itself as an exit node.
+	// Overrides the global setting.
+	AdvertiseExitNode opt.Bool `json:"advertise_exit_node,omitempty" caddy:"namespace=tailscale.advertise_exit_node"`
+
+	// AcceptRoutes specifies whether the node accepts subnet routes advertised by other nodes.
+	// Overrides the global setting.
+	AcceptRoutes opt.Bool `json:"accept_routes,omitempty" caddy:"namespace=tailscale.accept_routes"`
+
+	// AcceptDNS specifies whether the node uses the tailnet's DNS configuration.
+	// Overrides the global setting.
+	AcceptDNS opt.Bool `json:"accept_dns,omitempty" caddy:"namespace=tailscale.accept_dns"`
+
+	// SOCKS5Listen is the local address, such as "localhost:1080",
+	// on which to serve a SOCKS5 proxy that dials through the node.
+	// This lets other processes on the host reach the tailnet without their own Tailscale client.
+	SOCKS5Listen string `json:"socks5_listen,omitempty" caddy:"namespace=tailscale.socks5_listen"`
+
+	// HTTPProxyListen is the local address, such as "localhost:8080",
+	// on which to serve an HTTP proxy, supporting CONNECT, that dials through the node.
+	HTTPProxyListen string `json:"http_proxy_listen,omitempty" caddy:"namespace=tailscale.http_proxy_listen"`
+
+	// ProxyUsername and ProxyPassword, if set, are the credentials that clients of the node's proxies must provide.
+	// Both are required if a proxy listens on an address other than a loopback address or unix socket.
+	ProxyUsername string `json:"proxy_username,omitempty" caddy:"namespace=tailscale.proxy_username"`
+	ProxyPassword string `json:"proxy_password,omitempty" caddy:"namespace=tailscale.proxy_password"`
+
 	// Tags to apply to the node when registered. Overrides global tags.
 	Tags []string `json:"tags,omitempty" caddy:"namespace=tailscale.tags"`
 
+	// LoginTimeout specifies how long to wait for the node to log in when it is first used.
+	// Overrides the global login timeout.
+	LoginTimeout caddy.Duration `json:"login_timeout,omitempty" caddy:"namespace=tailscale.login_timeout"`
+
+	// WaitForRunning specifies whether listeners on the node should wait for the node to be running
+	// before they are created. Overrides the global setting.
+	WaitForRunning opt.Bool `json:"wait_for_running,omitempty" caddy:"namespace=tailscale.wait_for_running"`
+
+	// StartupTimeout specifies how long to wait for the node to be running when WaitForRunning is set.
+	// Overrides the global startup timeout.
+	StartupTimeout caddy.Duration `json:"startup_timeout,omitempty" caddy:"namespace=tailscale.startup_timeout"`
+
 	// Hostname is the hostname to use when registering the node.
 	Hostname string `json:"hostname,omitempty" caddy:"namespace=tailscale.hostname"`
 
@@ -77,6 +200,10 @@ type Node struct {
 	// StateDir specifies the state directory for the node.
 	StateDir string `json:"state_dir,omitempty" caddy:"namespace=tailscale.state_dir"`
 
+	// StateStore specifies where the node stores its Tailscale state.
+	// Overrides the global state store.
+	StateStore string `json:"state_store,omitempty" caddy:"namespace=tailscale.state_store"`
+
 	name string
 }
 
@@ -89,14 +216,45 @@ func (App) CaddyModule() caddy.ModuleInfo {
 
 func (t *App) Provision(ctx caddy.Context) error {
 	t.logger = ctx.Logger(t)
+	t.ctx = ctx
+	return registerMetrics(ctx.GetMetricsRegistry())
+}
+
+// Validate ensures the App config is valid.
+func (t *App) Validate() error {
+	if t.OAuthClientSecret != "" && t.OAuthClientID == "" {
+		return errors.New("oauth_client_secret is set without an oauth_client_id")
+	}
+	if t.OAuthClientSecret != "" && t.DefaultAuthKey == "" && t.AuthKeyFile == "" && len(t.Tags) == 0 {
+		return errors.New("tags are required to mint auth keys with oauth_client_secret")
+	}
+	for _, name := range slices.Sorted(maps.Keys(t.Nodes)) {
+		node := t.Nodes[name]
+		if node.OAuthClientSecret != "" && node.OAuthClientID == "" {
+			return fmt.Errorf("tailscale node %s: oauth_client_secret is set without an oauth_client_id", name)
+		}
+		// Nodes without their own auth key mint one with the default OAuth client.
+		mints := node.OAuthClientSecret != "" ||
+			(node.AuthKey == "" && node.AuthKeyFile == "" && t.DefaultAuthKey == "" && t.AuthKeyFile == "" && t.OAuthClientSecret != "")
+		if mints && len(getTags(name, t)) == 0 {
+			return fmt.Errorf("tailscale node %s: tags are required to mint auth keys with oauth_client_secret", name)
+		}
+		// Proxies without credentials would let anyone who can reach them into the tailnet.
+		for _, addr := range []string{node.SOCKS5Listen, node.HTTPProxyListen} {
+			if addr != "" && !isLoopbackProxyAddr(addr) && (node.ProxyUsername == "" || node.ProxyPassword == "") {
+				return fmt.Errorf("tailscale node %s: proxy_auth with a username and password is required to serve a proxy on %s, which is not a loopback address", name, addr)
+			}
+		}
+	}
 	return nil
 }
 
 func (t *App) Start() error {
-	return nil
+	return t.startProxies()
 }
 
 func (t *App) Stop() error {
+	t.stopProxies()
 	return nil
 }
 
@@ -118,6 +276,21 @@ func parseAppConfig(d *caddyfile.Dispenser, _ any) (any, error) {
 				return nil, d.ArgErr()
 			}
 			app.DefaultAuthKey = d.Val()
+		case "auth_key_file":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			app.AuthKeyFile = d.Val()
+		case "oauth_client_id":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			app.OAuthClientID = d.Val()
+		case "oauth_client_secret":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			app.OAuthClientSecret = d.Val()
 		case "control_url":
 			if !d.NextArg() {
 				return nil, d.ArgErr()
@@ -138,6 +311,12 @@ func parseAppConfig(d *caddyfile.Dispenser, _ any) (any, error) {
 				return nil, d.ArgErr()
 			}
 			app.StateDir = d.Val()
+		case "state_store":
+			v, err := parseStateStore(d)
+			if err != nil {
+				return nil, err
+			}
+			app.StateStore = v
 		case "webui":
 			if d.NextArg() {
 				v, err := strconv.ParseBool(d.Val())
@@ -150,6 +329,62 @@ func parseAppConfig(d *caddyfile.Dispenser, _ any) (any, error) {
 			}
 		case "tags":
 			app.Tags = d.RemainingArgs()
+		case "login_timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			v, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.WrapErr(err)
+			}
+			app.LoginTimeout = caddy.Duration(v)
+		case "wait_for_running":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return nil, d.WrapErr(err)
+				}
+				app.WaitForRunning = v
+			} else {
+				app.WaitForRunning = true
+			}
+		case "startup_timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			v, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.WrapErr(err)
+			}
+			app.StartupTimeout = caddy.Duration(v)
+		case "advertise_routes":
+			routes, err := parseRoutes(d)
+			if err != nil {
+				return nil, err
+			}
+			app.AdvertiseRoutes = routes
+		case "advertise_exit_node":
+			if d.NextArg() {
+				v, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return nil, d.WrapErr(err)
+				}
+				app.AdvertiseExitNode = v
+			} else {
+				app.AdvertiseExitNode = true
+			}
+		case "accept_routes":
+			v, err := parseOptBool(d)
+			if err != nil {
+				return nil, err
+			}
+			app.AcceptRoutes = v
+		case "accept_dns":
+			v, err := parseOptBool(d)
+			if err != nil {
+				return nil, err
+			}
+			app.AcceptDNS = v
 		default:
 			node, err := parseNodeConfig(d)
 			if app.Nodes == nil {
@@ -185,6 +420,21 @@ func parseNodeConfig(d *caddyfile.Dispenser) (Node, error) {
 				return node, segment.ArgErr()
 			}
 			node.AuthKey = segment.Val()
+		case "auth_key_file":
+			if !segment.NextArg() {
+				return node, segment.ArgErr()
+			}
+			node.AuthKeyFile = segment.Val()
+		case "oauth_client_id":
+			if !segment.NextArg() {
+				return node, segment.ArgErr()
+			}
+			node.OAuthClientID = segment.Val()
+		case "oauth_client_secret":
+			if !segment.NextArg() {
+				return node, segment.ArgErr()
+			}
+			node.OAuthClientSecret = segment.Val()
 		case "control_url":
 			if !segment.NextArg() {
 				return node, segment.ArgErr()
@@ -221,6 +471,12 @@ func parseNodeConfig(d *caddyfile.Dispenser) (Node, error) {
 				return node, segment.ArgErr()
 			}
 			node.StateDir = segment.Val()
+		case "state_store":
+			v, err := parseStateStore(segment)
+			if err != nil {
+				return node, err
+			}
+			node.StateStore = v
 		case "webui":
 			if segment.NextArg() {
 				v, err := strconv.ParseBool(segment.Val())
@@ -231,8 +487,99 @@ func parseNodeConfig(d *caddyfile.Dispenser) (Node, error) {
 			} else {
 				node.WebUI = opt.NewBool(true)
 			}
+		case "funnel":
+			if segment.NextArg() {
+				v, err := strconv.ParseBool(segment.Val())
+				if err != nil {
+					return node, segment.WrapErr(err)
+				}
+				node.Funnel = v
+			} else {
+				node.Funnel = true
+			}
+		case "advertise_services":
+			node.AdvertiseServices = segment.RemainingArgs()
+			if len(node.AdvertiseServices) == 0 {
+				return node, segment.ArgErr()
+			}
+			for _, s := range node.AdvertiseServices {
+				if _, err := serviceName(s); err != nil {
+					return node, segment.WrapErr(err)
+				}
+			}
+		case "socks5_listen":
+			if !segment.NextArg() {
+				return node, segment.ArgErr()
+			}
+			node.SOCKS5Listen = segment.Val()
+		case "http_proxy_listen":
+			if !segment.NextArg() {
+				return node, segment.ArgErr()
+			}
+			node.HTTPProxyListen = segment.Val()
+		case "proxy_auth":
+			if !segment.NextArg() {
+				return node, segment.ArgErr()
+			}
+			node.ProxyUsername = segment.Val()
+			if !segment.NextArg() {
+				return node, segment.ArgErr()
+			}
+			node.ProxyPassword = segment.Val()
 		case "tags":
 			node.Tags = segment.RemainingArgs()
+		case "login_timeout":
+			if !segment.NextArg() {
+				return node, segment.ArgErr()
+			}
+			v, err := caddy.ParseDuration(segment.Val())
+			if err != nil {
+				return node, segment.WrapErr(err)
+			}
+			node.LoginTimeout = caddy.Duration(v)
+		case "wait_for_running":
+			if segment.NextArg() {
+				v, err := strconv.ParseBool(segment.Val())
+				if err != nil {
+					return node, segment.WrapErr(err)
+				}
+				node.WaitForRunning = opt.NewBool(v)
+			} else {
+				node.WaitForRunning = opt.NewBool(true)
+			}
+		case "startup_timeout":
+			if !segment.NextArg() {
+				return node, segment.ArgErr()
+			}
+			v, err := caddy.ParseDuration(segment.Val())
+			if err != nil {
+				return node, segment.WrapErr(err)
+			}
+			node.StartupTimeout = caddy.Duration(v)
+		case "advertise_routes":
+			routes, err := parseRoutes(segment)
+			if err != nil {
+				return node, err
+			}
+			node.AdvertiseRoutes = routes
+		case "advertise_exit_node":
+			v, err := parseOptBool(segment)
+			if err != nil {
+				return node, err
+			}
+			node.AdvertiseExitNode = v
+		case "accept_routes":
+			v, err := parseOptBool(segment)
+			if err != nil {
+				return node, err
+			}
+			node.AcceptRoutes = v
+		case "accept_dns":
+			v, err := parseOptBool(segment)
+			if err != nil {
+				return node, err
+			}
+			node.AcceptDNS = v
 		default:
 			return node, segment.Errf("unrecognized subdirective: %s", segment.Val())
 		}
@@ -241,7 +588,54 @@ func parseNodeConfig(d *caddyfile.Dispenser) (Node, error) {
 	return node, nil
 }
 
+// parseOptBool parses the optional boolean argument of the current directive,
+// which is true if omitted.
+func parseOptBool(d *caddyfile.Dispenser) (opt.Bool, error) {
+	if !d.NextArg() {
+		return opt.NewBool(true), nil
+	}
+	v, err := strconv.ParseBool(d.Val())
+	if err != nil {
+		return "", d.WrapErr(err)
+	}
+	return opt.NewBool(v), nil
+}
+
+// parseStateStore parses the state store argument of the current directive.
+func parseStateStore(d *caddyfile.Dispenser) (string, error) {
+	if !d.NextArg() {
+		return "", d.ArgErr()
+	}
+	switch v := d.Val(); v {
+	case stateStoreFile, stateStoreCaddyStorage:
+		return v, nil
+	default:
+		return "", d.Errf("unknown state store %q, must be %q or %q", v, stateStoreFile, stateStoreCaddyStorage)
+	}
+}
+
+// parseRoutes parses the subnet route arguments of the current directive.
+func parseRoutes(d *caddyfile.Dispenser) ([]netip.Prefix, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return nil, d.ArgErr()
+	}
+	routes := make([]netip.Prefix, 0, len(args))
+	for _, arg := range args {
+		route, err := netip.ParsePrefix(arg)
+		if err != nil {
+			return nil, d.WrapErr(err)
+		}
+		if route != route.Masked() {
+			return nil, d.Errf("route %s has non-address bits set, use %s", route, route.Masked())
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
 var (
 	_ caddy.App         = (*App)(nil)
 	_ caddy.Provisioner = (*App)(nil)
+	_ caddy.Validator   = (*App)(nil)
 )
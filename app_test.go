@@ -81,6 +81,166 @@ func Test_ParseApp(t *testing.T) {
 				}`),
 			wantErr: true,
 		},
+		{
+			name: "oauth client",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					auth_key_file /run/secrets/ts_authkey
+					oauth_client_id {env.TS_CLIENT_ID}
+					oauth_client_secret {env.TS_CLIENT_SECRET}
+					tags tag:caddy
+				}`),
+			want: `{"auth_key_file":"/run/secrets/ts_authkey","oauth_client_id":"{env.TS_CLIENT_ID}","oauth_client_secret":"{env.TS_CLIENT_SECRET}","tags":["tag:caddy"]}`,
+		},
+		{
+			name: "missing oauth client secret",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					oauth_client_secret
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "login_timeout",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					login_timeout 2m
+					foo {
+						login_timeout 30s
+					}
+				}`),
+			want: `{"login_timeout":120000000000,"nodes":{"foo":{"login_timeout":30000000000}}}`,
+		},
+		{
+			name: "invalid login_timeout",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					login_timeout soon
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "wait_for_running",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					wait_for_running
+					startup_timeout 2m
+					foo {
+						wait_for_running false
+						startup_timeout 30s
+					}
+				}`),
+			want: `{"wait_for_running":true,"startup_timeout":120000000000,"nodes":{"foo":{"wait_for_running":false,"startup_timeout":30000000000}}}`,
+		},
+		{
+			name: "funnel",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						funnel
+					}
+					bar {
+						funnel false
+					}
+				}`),
+			want: `{"nodes":{"bar":{},"foo":{"funnel":true}}}`,
+		},
+		{
+			name: "advertise_services",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						advertise_services svc:web api
+					}
+				}`),
+			want: `{"nodes":{"foo":{"advertise_services":["svc:web","api"]}}}`,
+		},
+		{
+			name: "invalid advertise_services",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						advertise_services svc:Not_Valid
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "routing prefs",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					advertise_routes 10.0.0.0/24 fd00::/64
+					advertise_exit_node
+					accept_routes false
+					accept_dns
+					foo {
+						advertise_routes 192.168.1.0/24
+						advertise_exit_node false
+						accept_routes
+						accept_dns false
+					}
+				}`),
+			want: `{"advertise_routes":["10.0.0.0/24","fd00::/64"],"advertise_exit_node":true,"accept_routes":false,"accept_dns":true,"nodes":{"foo":{"advertise_routes":["192.168.1.0/24"],"advertise_exit_node":false,"accept_routes":true,"accept_dns":false}}}`,
+		},
+		{
+			name: "invalid advertise_routes",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					advertise_routes 10.0.0.1/24
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "proxies",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						socks5_listen localhost:1080
+						http_proxy_listen localhost:8080
+						proxy_auth user {env.PROXY_PASSWORD}
+					}
+				}`),
+			want: `{"nodes":{"foo":{"socks5_listen":"localhost:1080","http_proxy_listen":"localhost:8080","proxy_username":"user","proxy_password":"{env.PROXY_PASSWORD}"}}}`,
+		},
+		{
+			name: "proxy_auth without password",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						proxy_auth user
+					}
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "state_store",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					state_store caddy_storage
+					foo {
+						state_store file
+					}
+				}`),
+			want: `{"state_store":"caddy_storage","nodes":{"foo":{"state_store":"file"}}}`,
+		},
+		{
+			name: "invalid state_store",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					state_store memory
+				}`),
+			wantErr: true,
+		},
+		{
+			name: "invalid startup_timeout",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						startup_timeout soon
+					}
+				}`),
+			wantErr: true,
+		},
 		{
 			name: "empty server",
 			d: caddyfile.NewTestDispenser(`
@@ -104,6 +264,21 @@ func Test_ParseApp(t *testing.T) {
 			wantErr: false,
 			authKey: "tskey-node",
 		},
+		{
+			name: "server with oauth client",
+			d: caddyfile.NewTestDispenser(`
+				tailscsale {
+					foo {
+						oauth_client_id client-id
+						oauth_client_secret tskey-client-secret
+						tags tag:web
+					}
+					bar {
+						auth_key_file /run/secrets/bar_authkey
+					}
+				}`),
+			want: `{"nodes":{"foo":{"oauth_client_id":"client-id","oauth_client_secret":"tskey-client-secret","tags":["tag:web"]},"bar":{"auth_key_file":"/run/secrets/bar_authkey"}}}`,
+		},
 	}
 
 	for _, testcase := range tests {
@@ -132,6 +307,83 @@ func Test_ParseApp(t *testing.T) {
 
 }
 
+func Test_ValidateApp(t *testing.T) {
+	tests := map[string]struct {
+		app     *App
+		wantErr bool
+	}{
+		"empty": {
+			app: &App{},
+		},
+		"oauth client": {
+			app: &App{
+				OAuthClientID:     "id",
+				OAuthClientSecret: "secret",
+				Tags:              []string{"tag:caddy"},
+				Nodes:             map[string]Node{"node": {OAuthClientID: "id", OAuthClientSecret: "secret"}},
+			},
+		},
+		"oauth client without tags": {
+			app:     &App{OAuthClientID: "id", OAuthClientSecret: "secret"},
+			wantErr: true,
+		},
+		"node oauth client without tags": {
+			app:     &App{Nodes: map[string]Node{"node": {OAuthClientID: "id", OAuthClientSecret: "secret"}}},
+			wantErr: true,
+		},
+		"node overrides tags of oauth client": {
+			app: &App{
+				OAuthClientID:     "id",
+				OAuthClientSecret: "secret",
+				Tags:              []string{"tag:caddy"},
+				Nodes:             map[string]Node{"node": {Tags: []string{}}},
+			},
+			wantErr: true,
+		},
+		"node with auth key and no tags": {
+			app: &App{
+				OAuthClientID:     "id",
+				OAuthClientSecret: "secret",
+				Tags:              []string{"tag:caddy"},
+				Nodes:             map[string]Node{"node": {AuthKey: "key", Tags: []string{}}},
+			},
+		},
+		"secret without client id": {
+			app:     &App{OAuthClientSecret: "secret"},
+			wantErr: true,
+		},
+		"node secret without client id": {
+			app:     &App{OAuthClientID: "id", Nodes: map[string]Node{"node": {OAuthClientSecret: "secret"}}},
+			wantErr: true,
+		},
+		"loopback proxies without auth": {
+			app: &App{Nodes: map[string]Node{"node": {SOCKS5Listen: "localhost:1080", HTTPProxyListen: "127.0.0.1:8080"}}},
+		},
+		"proxy with auth": {
+			app: &App{Nodes: map[string]Node{"node": {SOCKS5Listen: ":1080", ProxyUsername: "user", ProxyPassword: "pass"}}},
+		},
+		"proxy without auth": {
+			app:     &App{Nodes: map[string]Node{"node": {HTTPProxyListen: "0.0.0.0:8080"}}},
+			wantErr: true,
+		},
+		"proxy without password": {
+			app:     &App{Nodes: map[string]Node{"node": {SOCKS5Listen: ":1080", ProxyUsername: "user"}}},
+			wantErr: true,
+		},
+		"proxy without username": {
+			app:     &App{Nodes: map[string]Node{"node": {HTTPProxyListen: ":8080", ProxyPassword: "pass"}}},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := tt.app.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func compareJSON(s1, s2 string, t *testing.T) string {
 	var v1, v2 map[string]any
 	if err := json.Unmarshal([]byte(s1), &v1); err != nil {
@@ -6,19 +6,27 @@ package tscaddy
 // auth.go contains the TailscaleAuth module and supporting logic.
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"reflect"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"go.uber.org/zap"
 	"tailscale.com/client/local"
-	"tailscale.com/tsnet"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
 )
 
 func init() {
@@ -28,11 +36,69 @@ func init() {
 }
 
 // Auth is an HTTP authentication provider that authenticates users based on their Tailscale identity.
-// If configured on a caddy site that is listening on a tailscale node,
-// that node will be used to identify the user information for inbound requests.
-// Otherwise, it will attempt to find and use the local tailscaled daemon running on the system.
+// If a node is configured, that node will be used to identify the user information for inbound requests.
+// Otherwise, if the request was received on a tailscale node, that node will be used.
+// If neither, it will attempt to find and use the local tailscaled daemon running on the system.
+//
+// By default, only requests from user-owned nodes are authenticated.
+// Tagged nodes can be allowed with AllowTagged or AllowedTags,
+// in which case the node itself is treated as the authenticated principal.
 type Auth struct {
-	localclient *local.Client
+	// Node is the name of the Tailscale node used to identify connecting peers.
+	// If empty, the node the request was received on is used,
+	// or the local tailscaled daemon if the request was not received on a Tailscale node.
+	Node string `json:"node,omitempty"`
+
+	// AllowTagged allows requests from tagged nodes.
+	AllowTagged bool `json:"allow_tagged,omitempty"`
+
+	// AllowedTags allows requests from tagged nodes that have any of these tags.
+	// Tagged nodes without a matching tag are rejected.
+	// Setting AllowedTags implies AllowTagged.
+	AllowedTags []string `json:"allowed_tags,omitempty"`
+
+	// DenyUsers is a list of user login names, or node names for tagged nodes,
+	// that are never authenticated.
+	DenyUsers []string `json:"deny_users,omitempty"`
+
+	// RequireTailnet rejects requests from nodes that are not members of this tailnet,
+	// such as nodes from other tailnets that have been shared with this node.
+	RequireTailnet string `json:"require_tailnet,omitempty"`
+
+	// Capability is the name of a peer capability, such as "example.com/cap/grafana",
+	// granted to connecting nodes through the tailnet policy file.
+	// The values of the capability are exposed as tailscale_cap.* user metadata.
+	Capability string `json:"capability,omitempty"`
+
+	// RequireCapability rejects requests from nodes that have not been granted Capability.
+	RequireCapability bool `json:"require_capability,omitempty"`
+
+	// CacheTTL is how long the identity of a connecting peer is cached.
+	// Cached identities are also invalidated whenever the network map of the node changes.
+	// If zero, identities are not cached.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// AllowFunnel authenticates requests that arrived from the public internet over Tailscale Funnel
+	// as an anonymous user with an empty ID and empty Tailscale user metadata.
+	// By default, requests that arrived over Funnel are rejected.
+	// Whether a request arrived over Funnel is available as the {tailscale.funnel} placeholder.
+	AllowFunnel bool `json:"allow_funnel,omitempty"`
+
+	// TrustedProxies are the names or tags of tailscale nodes, such as other Caddy instances
+	// using the tailscale transport with forward_identity, whose forwarded identities are trusted.
+	// Requests from a trusted proxy with a valid Tailscale-Identity header authenticate
+	// the identity of the proxy's client instead of the proxy.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// ForwardedIdentitySecret is the secret that the trusted proxies sign forwarded identities with.
+	ForwardedIdentitySecret string `json:"forwarded_identity_secret,omitempty"`
+
+	// identitySecret is ForwardedIdentitySecret with placeholders replaced.
+	identitySecret string
+
+	node   *tailscaleNode
+	cache  *whoIsCache
+	logger *zap.Logger
 }
 
 func (Auth) CaddyModule() caddy.ModuleInfo {
@@ -42,86 +108,172 @@ func (Auth) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// findTsnetListener recursively searches ln for wrapped or embedded net.Listeners
-// until it finds a tsnetListener or runs out.
-// ok indicates if a tsnetListener was found.
-//
-// In the future consider alternative approach if Caddy supports unwrapping listeners.
-// See discussion in https://github.com/tailscale/caddy-tailscale/pull/70
-func findTsnetListener(ln net.Listener) (_ tsnetListener, ok bool) {
-	if ln == nil {
-		return nil, false
+// Provision gets a reference to the configured node, if any.
+// Otherwise, it registers a hook to resolve the tailscale node for each connection when it is accepted.
+func (ta *Auth) Provision(ctx caddy.Context) error {
+	ta.logger = ctx.Logger(ta)
+	if err := registerMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return err
+	}
+	if ta.CacheTTL > 0 {
+		ta.cache = newWhoIsCache(time.Duration(ta.CacheTTL), ta.logger)
 	}
+	registerFunnelConnContext(ctx)
 
-	// if ln is a tsnetListener, return it.
-	if tsn, ok := ln.(tsnetListener); ok {
-		return tsn, true
+	if ta.ForwardedIdentitySecret != "" {
+		var err error
+		ta.identitySecret, err = repl.ReplaceOrErr(ta.ForwardedIdentitySecret, true, true)
+		if err != nil {
+			return fmt.Errorf("forwarded_identity_secret: %w", err)
+		}
 	}
 
-	// if ln is a wrappedListener, unwrap it.
-	if wl, ok := ln.(wrappedListener); ok {
-		return findTsnetListener(wl.Unwrap())
+	if ta.Node == "" {
+		registerLocalClientConnContext(ctx)
+		return nil
 	}
 
-	// if ln has an embedded net.Listener field, unwrap it.
-	s := reflect.ValueOf(ln)
-	if s.Kind() == reflect.Pointer {
-		s = s.Elem()
+	var err error
+	ta.node, err = getNode(ctx, ta.Node)
+	return err
+}
+
+// Cleanup releases the reference to the configured node, if any,
+// and stops the identity cache.
+func (ta *Auth) Cleanup() error {
+	if ta.cache != nil {
+		hits, misses := ta.cache.stats()
+		ta.logger.Debug("stopping identity cache", zap.Uint64("hits", hits), zap.Uint64("misses", misses))
+		ta.cache.Close()
 	}
-	if s.Kind() != reflect.Struct {
-		return nil, false
+
+	return releaseNode(ta.Node, ta.node)
+}
+
+// Validate ensures the Auth config is valid.
+func (ta *Auth) Validate() error {
+	if ta.RequireCapability && ta.Capability == "" {
+		return errors.New("require_capability is set without a capability")
 	}
+	if ta.CacheTTL < 0 {
+		return errors.New("cache_ttl must not be negative")
+	}
+	if (len(ta.TrustedProxies) > 0) != (ta.ForwardedIdentitySecret != "") {
+		return errors.New("trusted_proxies and forwarded_identity_secret must be set together")
+	}
+	return nil
+}
 
-	innerLn := s.FieldByName("Listener")
-	if !innerLn.IsValid() || innerLn.IsZero() {
-		// no more child/embedded listeners left
-		return nil, false
+// client returns the tailscale LocalClient for the TailscaleAuth module.
+// If a node is configured, the LocalClient for that node is returned.
+// Otherwise, the LocalClient of the tailscale node that accepted the request's connection is used.
+func (ta *Auth) client(r *http.Request) (*local.Client, error) {
+	if ta.node != nil {
+		return ta.node.LocalClient()
 	}
+	return localClientForRequest(r)
+}
+
+// localClientCtxKey is the context key for the [local.Client] that can identify
+// the peers of a connection. It is set on the connection context by [localClientConnContext].
+type localClientCtxKey struct{}
 
-	// if the "Listener" field is a net.Listener, use it.
-	if wl, ok := innerLn.Interface().(net.Listener); ok {
-		return findTsnetListener(wl)
+// tailscaledClient is a LocalClient that talks to the local tailscaled daemon.
+var tailscaledClient = new(local.Client)
+
+// registerLocalClientConnContext registers a ConnContext hook on the caddy HTTP server being provisioned,
+// so that the LocalClient for each connection is resolved once when the connection is accepted,
+// rather than on every request.
+func registerLocalClientConnContext(ctx caddy.Context) {
+	if server, ok := ctx.Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok && server != nil {
+		server.RegisterConnContext(localClientConnContext)
 	}
-	return nil, false
 }
 
-// wrappedListener is implemented by types that wrap net.Listeners.
-type wrappedListener interface {
-	Unwrap() net.Listener
+// localClientConnContext stores the LocalClient that can identify the peers of c in the connection context.
+func localClientConnContext(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := ctx.Value(localClientCtxKey{}).(*local.Client); ok {
+		// already resolved by another module on the same server
+		return ctx
+	}
+	lc, err := localClientForConn(c)
+	if err != nil {
+		// resolve again for each request, which will surface the error
+		return ctx
+	}
+	return context.WithValue(ctx, localClientCtxKey{}, lc)
 }
 
-// client returns the tailscale LocalClient for the TailscaleAuth module.
-// If the LocalClient has not already been configured, the provided request will be used to
-// lookup the tailscale node that serviced the request, and get the associated LocalClient.
-func (ta *Auth) client(r *http.Request) (*local.Client, error) {
-	if ta.localclient != nil {
-		return ta.localclient, nil
+// localClientForRequest returns the tailscale LocalClient that can identify the peer of r.
+// The LocalClient is usually resolved when the connection is accepted and stored in the connection context.
+// Otherwise, such as for HTTP/3 requests, it is resolved from the local address of the request.
+func localClientForRequest(r *http.Request) (*local.Client, error) {
+	if lc, ok := r.Context().Value(localClientCtxKey{}).(*local.Client); ok {
+		return lc, nil
 	}
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return localClientForAddr(localAddr)
+}
 
-	// if request was made through a tsnet listener, set up the client for the associated tsnet
-	// server.
-	server := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
-	for _, listener := range server.Listeners() {
-		if tsl, ok := findTsnetListener(listener); ok {
-			var err error
-			ta.localclient, err = tsl.Server().LocalClient()
-			if err != nil {
-				return nil, err
-			}
+// localClientForConn returns the tailscale LocalClient for the connection c.
+// If c, or any connection it wraps, was accepted by a tailscale node, the LocalClient for that node is returned.
+// Otherwise, the LocalClient is resolved from the local address of c.
+func localClientForConn(c net.Conn) (*local.Client, error) {
+	for inner := c; inner != nil; {
+		switch ic := inner.(type) {
+		case *serviceConn:
+			// the local address of a service connection is not one of the node's Tailscale IPs
+			return ic.node.LocalClient()
+		case interface{ NetConn() net.Conn }:
+			inner = ic.NetConn()
+		default:
+			inner = nil
 		}
 	}
+	return localClientForAddr(c.LocalAddr())
+}
+
+// localClientForAddr returns the tailscale LocalClient for the connection with local address addr.
+// If addr is one of the Tailscale IPs of a running tailscale node, the LocalClient for that node is returned.
+// Otherwise, a client for the local tailscaled daemon is returned.
+func localClientForAddr(addr net.Addr) (*local.Client, error) {
+	if node, ok := nodeForAddr(addr); ok {
+		return node.LocalClient()
+	}
+	return tailscaledClient, nil
+}
 
-	if ta.localclient == nil {
-		// default to empty client that will talk to local tailscaled
-		ta.localclient = new(local.Client)
+// nodeForAddr returns the tailscale node that has the IP address of addr as one of its Tailscale IPs.
+func nodeForAddr(addr net.Addr) (node *tailscaleNode, ok bool) {
+	ip, isIP := addrIP(addr)
+	if !isIP {
+		return nil, false
 	}
 
-	return ta.localclient, nil
+	nodes.Range(func(_, value any) bool {
+		n, isNode := value.(*tailscaleNode)
+		if !isNode || !n.started() {
+			return true
+		}
+		if ip4, ip6 := n.TailscaleIPs(); ip == ip4 || ip == ip6 {
+			node, ok = n, true
+			return false
+		}
+		return true
+	})
+	return node, ok
 }
 
-// tsnetListener is an interface that is implemented by [tsnet.Listener].
-type tsnetListener interface {
-	Server() *tsnet.Server
+// addrIP returns the IP address of addr, if it has one.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
 }
 
 // Authenticate authenticates the request and sets Tailscale user data on the caddy User object.
@@ -132,51 +284,406 @@ type tsnetListener interface {
 //   - tailscale_name: the user's display name
 //   - tailscale_profile_picture: the user's profile picture URL
 //   - tailscale_tailnet: the user's tailnet name (if the user is not connecting to a shared node)
-func (ta Auth) Authenticate(w http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
-	user := caddyauth.User{}
+//   - tailscale_node: the fully qualified name of the connecting node
+//   - tailscale_tags: comma separated list of the node's tags (for tagged nodes)
+//   - tailscale_cap: JSON array of the values of the configured capability
+//   - tailscale_cap.<field>: each field of the configured capability's values
+//
+// Capability values are JSON objects. Nested object fields are joined with a dot,
+// and array values, or values from multiple grants of the same field, are joined with a comma.
+//
+// For tagged nodes, the user ID is the node name, and user specific fields are left empty.
+//
+// Requests that arrived over Funnel are not from a tailnet peer, so have no Tailscale identity.
+// They are rejected, unless AllowFunnel is set.
+func (ta *Auth) Authenticate(w http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
+	if isFunnelRequest(r) {
+		if !ta.AllowFunnel {
+			return caddyauth.User{}, false, errors.New("request arrived over Tailscale Funnel")
+		}
+		return anonymousFunnelUser(), true, nil
+	}
 
 	client, err := ta.client(r)
 	if err != nil {
-		return user, false, err
+		return caddyauth.User{}, false, err
 	}
 
-	info, err := client.WhoIs(r.Context(), r.RemoteAddr)
+	info, err := ta.whoIs(r.Context(), client, r.RemoteAddr)
 	if err != nil {
-		return user, false, err
+		return caddyauth.User{}, false, err
 	}
 
-	if len(info.Node.Tags) != 0 {
-		return user, false, fmt.Errorf("node %s has tags", info.Node.Hostinfo.Hostname())
+	if token := r.Header.Get(identityHeader); token != "" && ta.isTrustedProxy(info) {
+		info, err = ta.forwardedIdentity(token, info, time.Now())
+		if err != nil {
+			return caddyauth.User{}, false, err
+		}
+	}
+
+	return ta.authenticate(info)
+}
+
+// isTrustedProxy reports whether the WhoIs peer info is one of the trusted proxies,
+// either by its short MagicDNS name, its fully qualified domain name, or one of its tags.
+func (ta *Auth) isTrustedProxy(info *apitype.WhoIsResponse) bool {
+	fqdn := strings.TrimSuffix(info.Node.Name, ".")
+	return slices.ContainsFunc(ta.TrustedProxies, func(p string) bool {
+		if strings.HasPrefix(p, "tag:") {
+			return slices.Contains(info.Node.Tags, p)
+		}
+		return strings.EqualFold(p, info.Node.ComputedName) || strings.EqualFold(strings.TrimSuffix(p, "."), fqdn)
+	})
+}
+
+// forwardedIdentity returns the identity forwarded by the trusted proxy with WhoIs response proxy,
+// verifying that token was signed by that proxy and has not expired at now.
+func (ta *Auth) forwardedIdentity(token string, proxy *apitype.WhoIsResponse, now time.Time) (*apitype.WhoIsResponse, error) {
+	issuer := identityIssuer{ID: proxy.Node.StableID, Name: proxy.Node.Name}
+	key, err := identityKey(ta.identitySecret, issuer)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := verifyIdentity(token, key, issuer, now)
+	if err != nil {
+		return nil, fmt.Errorf("verifying identity forwarded by %s: %w", strings.TrimSuffix(proxy.Node.Name, "."), err)
+	}
+	return claims.whoIs(), nil
+}
+
+// anonymousFunnelUser returns the user for requests that arrived over Funnel.
+func anonymousFunnelUser() caddyauth.User {
+	return caddyauth.User{
+		Metadata: map[string]string{
+			"tailscale_login":           "",
+			"tailscale_user":            "",
+			"tailscale_name":            "",
+			"tailscale_profile_picture": "",
+			"tailscale_tailnet":         "",
+			"tailscale_node":            "",
+			"tailscale_tags":            "",
+		},
+	}
+}
+
+// whoIs returns the identity of the peer at remoteAddr, using the identity cache if enabled.
+func (ta *Auth) whoIs(ctx context.Context, client *local.Client, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if ta.cache == nil {
+		return timedWhoIs(ctx, client, remoteAddr)
+	}
+	return ta.cache.WhoIs(ctx, client, remoteAddr)
+}
+
+// timedWhoIs looks up the identity of the peer at remoteAddr, recording the duration and errors in metrics.
+func timedWhoIs(ctx context.Context, client *local.Client, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	start := time.Now()
+	info, err := client.WhoIs(ctx, remoteAddr)
+	whoIsDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		whoIsErrors.Inc()
 	}
+	return info, err
+}
+
+// authenticate applies the configured policy to the WhoIs response info
+// and returns the authenticated caddy User.
+func (ta *Auth) authenticate(info *apitype.WhoIsResponse) (caddyauth.User, bool, error) {
+	user := caddyauth.User{}
+	nodeName := strings.TrimSuffix(info.Node.Name, ".")
 
-	var tailnet string
-	if !info.Node.Hostinfo.ShareeNode() {
-		if s, found := strings.CutPrefix(info.Node.Name, info.Node.ComputedName+"."); found {
-			tailnet = strings.TrimSuffix(s, ".")
+	if len(info.Node.Tags) != 0 {
+		if !ta.allowTags(info.Node.Tags) {
+			return user, false, fmt.Errorf("node %s has tags", info.Node.Hostinfo.Hostname())
 		}
+
+		user.ID = nodeName
+		user.Metadata = map[string]string{
+			"tailscale_login":           "",
+			"tailscale_user":            "",
+			"tailscale_name":            "",
+			"tailscale_profile_picture": "",
+			"tailscale_tailnet":         tailnetName(info),
+			"tailscale_node":            nodeName,
+			"tailscale_tags":            strings.Join(info.Node.Tags, ","),
+		}
+	} else {
+		user.ID = info.UserProfile.LoginName
+		user.Metadata = map[string]string{
+			"tailscale_login":           strings.Split(info.UserProfile.LoginName, "@")[0],
+			"tailscale_user":            info.UserProfile.LoginName,
+			"tailscale_name":            info.UserProfile.DisplayName,
+			"tailscale_profile_picture": info.UserProfile.ProfilePicURL,
+			"tailscale_tailnet":         tailnetName(info),
+			"tailscale_node":            nodeName,
+			"tailscale_tags":            "",
+		}
+	}
+
+	if slices.Contains(ta.DenyUsers, user.ID) {
+		return caddyauth.User{}, false, fmt.Errorf("user %s is denied", user.ID)
 	}
 
-	user.ID = info.UserProfile.LoginName
-	user.Metadata = map[string]string{
-		"tailscale_login":           strings.Split(info.UserProfile.LoginName, "@")[0],
-		"tailscale_user":            info.UserProfile.LoginName,
-		"tailscale_name":            info.UserProfile.DisplayName,
-		"tailscale_profile_picture": info.UserProfile.ProfilePicURL,
-		"tailscale_tailnet":         tailnet,
+	if ta.RequireTailnet != "" && user.Metadata["tailscale_tailnet"] != ta.RequireTailnet {
+		return caddyauth.User{}, false, fmt.Errorf("user %s is not a member of tailnet %s", user.ID, ta.RequireTailnet)
 	}
+
+	if ta.Capability != "" {
+		values, ok := info.CapMap[tailcfg.PeerCapability(ta.Capability)]
+		if !ok && ta.RequireCapability {
+			return caddyauth.User{}, false, fmt.Errorf("user %s does not have capability %s", user.ID, ta.Capability)
+		}
+		if ok {
+			if err := addCapMetadata(user.Metadata, values); err != nil {
+				return caddyauth.User{}, false, fmt.Errorf("decoding capability %s: %w", ta.Capability, err)
+			}
+		}
+	}
+
 	return user, true, nil
 }
 
-func parseAuthConfig(_ httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+// addCapMetadata decodes the JSON capability values and adds them to the user metadata meta.
+func addCapMetadata(meta map[string]string, values []tailcfg.RawMessage) error {
+	raw := make([]string, len(values))
+	fields := make(map[string][]string)
+	for i, v := range values {
+		var decoded any
+		if err := json.Unmarshal([]byte(v), &decoded); err != nil {
+			return err
+		}
+		flattenCapValue("tailscale_cap", decoded, fields)
+		raw[i] = string(v)
+	}
+
+	meta["tailscale_cap"] = "[" + strings.Join(raw, ",") + "]"
+	for k, v := range fields {
+		meta[k] = strings.Join(v, ",")
+	}
+	return nil
+}
+
+// flattenCapValue adds the scalar values in v to fields, keyed by their dotted path under key.
+func flattenCapValue(key string, v any, fields map[string][]string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, vv := range v {
+			flattenCapValue(key+"."+k, vv, fields)
+		}
+	case []any:
+		for _, vv := range v {
+			flattenCapValue(key, vv, fields)
+		}
+	case nil:
+	default:
+		s := fmt.Sprint(v)
+		if !slices.Contains(fields[key], s) {
+			fields[key] = append(fields[key], s)
+		}
+	}
+}
+
+// allowTags reports whether a node with the provided tags is allowed.
+func (ta *Auth) allowTags(tags []string) bool {
+	if len(ta.AllowedTags) > 0 {
+		return slices.ContainsFunc(tags, func(t string) bool { return slices.Contains(ta.AllowedTags, t) })
+	}
+	return ta.AllowTagged
+}
+
+// tailnetName returns the name of the tailnet the WhoIs peer belongs to.
+// It returns an empty string if the peer is connecting to a shared node.
+func tailnetName(info *apitype.WhoIsResponse) string {
+	if info.Node.Hostinfo.ShareeNode() {
+		return ""
+	}
+	if s, found := strings.CutPrefix(info.Node.Name, info.Node.ComputedName+"."); found {
+		return strings.TrimSuffix(s, ".")
+	}
+	return ""
+}
+
+// parseAuthConfig parses the tailscale_auth directive.
+//
+//	tailscale_auth {
+//	  node <name>
+//	  allow_tagged [true|false]
+//	  allowed_tags <tags...>
+//	  deny_users <users...>
+//	  require_tailnet <tailnet>
+//	  capability <name>
+//	  require_capability [true|false]
+//	  cache_ttl <duration>
+//	  allow_funnel [true|false]
+//	  trusted_proxies <nodes or tags...>
+//	  forwarded_identity_secret <secret>
+//	  on_fail redirect <url> | <status>
+//	}
+//
+// By default, requests that fail authentication are rejected with a 401 status.
+// If on_fail is set, the authentication handler is wrapped in a subroute
+// that instead redirects the request or responds with the specified status.
+func parseAuthConfig(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var ta Auth
+	var onFail *caddyhttp.StaticResponse
+
+	h.Next() // skip directive name
+	if h.NextArg() {
+		return nil, h.ArgErr()
+	}
 
-	return caddyauth.Authentication{
+	for h.NextBlock(0) {
+		switch h.Val() {
+		case "node":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			ta.Node = h.Val()
+		case "allow_tagged":
+			if h.NextArg() {
+				v, err := strconv.ParseBool(h.Val())
+				if err != nil {
+					return nil, h.WrapErr(err)
+				}
+				ta.AllowTagged = v
+			} else {
+				ta.AllowTagged = true
+			}
+		case "allowed_tags":
+			tags := h.RemainingArgs()
+			if len(tags) == 0 {
+				return nil, h.ArgErr()
+			}
+			ta.AllowedTags = append(ta.AllowedTags, tags...)
+		case "deny_users":
+			users := h.RemainingArgs()
+			if len(users) == 0 {
+				return nil, h.ArgErr()
+			}
+			ta.DenyUsers = append(ta.DenyUsers, users...)
+		case "require_tailnet":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			ta.RequireTailnet = h.Val()
+		case "capability":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			ta.Capability = h.Val()
+		case "require_capability":
+			if h.NextArg() {
+				v, err := strconv.ParseBool(h.Val())
+				if err != nil {
+					return nil, h.WrapErr(err)
+				}
+				ta.RequireCapability = v
+			} else {
+				ta.RequireCapability = true
+			}
+		case "cache_ttl":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, h.Errf("invalid cache_ttl duration %q: %v", h.Val(), err)
+			}
+			ta.CacheTTL = caddy.Duration(ttl)
+		case "allow_funnel":
+			if h.NextArg() {
+				v, err := strconv.ParseBool(h.Val())
+				if err != nil {
+					return nil, h.WrapErr(err)
+				}
+				ta.AllowFunnel = v
+			} else {
+				ta.AllowFunnel = true
+			}
+		case "trusted_proxies":
+			proxies := h.RemainingArgs()
+			if len(proxies) == 0 {
+				return nil, h.ArgErr()
+			}
+			ta.TrustedProxies = append(ta.TrustedProxies, proxies...)
+		case "forwarded_identity_secret":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			ta.ForwardedIdentitySecret = h.Val()
+		case "on_fail":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			if h.Val() == "redirect" {
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				onFail = &caddyhttp.StaticResponse{
+					StatusCode: caddyhttp.WeakString(strconv.Itoa(http.StatusFound)),
+					Headers:    http.Header{"Location": []string{h.Val()}},
+				}
+			} else {
+				code, err := strconv.Atoi(h.Val())
+				if err != nil || code < 400 || code > 599 {
+					return nil, h.Errf("on_fail must be 'redirect <url>' or an HTTP error status code: %s", h.Val())
+				}
+				onFail = &caddyhttp.StaticResponse{
+					StatusCode: caddyhttp.WeakString(h.Val()),
+				}
+			}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+		default:
+			return nil, h.Errf("unrecognized subdirective: %s", h.Val())
+		}
+	}
+
+	authHandler := caddyauth.Authentication{
 		ProvidersRaw: caddy.ModuleMap{
 			"tailscale": caddyconfig.JSON(ta, nil),
 		},
+	}
+	if onFail == nil {
+		return authHandler, nil
+	}
+
+	// Authentication failures are returned as 401 errors, which are replaced by the on_fail response.
+	// All other errors are passed through unchanged.
+	return &caddyhttp.Subroute{
+		Routes: caddyhttp.RouteList{{
+			HandlersRaw: []json.RawMessage{
+				caddyconfig.JSONModuleObject(authHandler, "handler", "authentication", nil),
+			},
+		}},
+		Errors: &caddyhttp.HTTPErrorConfig{
+			Routes: caddyhttp.RouteList{
+				{
+					MatcherSetsRaw: []caddy.ModuleMap{{
+						"vars": caddyconfig.JSON(caddyhttp.VarsMatcher{
+							"{http.error.status_code}": []string{strconv.Itoa(http.StatusUnauthorized)},
+						}, nil),
+					}},
+					HandlersRaw: []json.RawMessage{
+						caddyconfig.JSONModuleObject(onFail, "handler", "static_response", nil),
+					},
+				},
+				{
+					HandlersRaw: []json.RawMessage{
+						caddyconfig.JSONModuleObject(caddyhttp.StaticError{
+							Error:      "{http.error.message}",
+							StatusCode: "{http.error.status_code}",
+						}, "handler", "error", nil),
+					},
+				},
+			},
+		},
 	}, nil
 }
 
 var (
 	_ caddyauth.Authenticator = (*Auth)(nil)
+	_ caddy.Provisioner       = (*Auth)(nil)
+	_ caddy.CleanerUpper      = (*Auth)(nil)
+	_ caddy.Validator         = (*Auth)(nil)
 )
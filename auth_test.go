@@ -0,0 +1,439 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/must"
+)
+
+func Test_ParseAuth(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		"empty": {
+			input: `tailscale_auth`,
+			want:  `{"providers":{"tailscale":{}}}`,
+		},
+		"allow_tagged": {
+			input: `tailscale_auth {
+				allow_tagged
+			}`,
+			want: `{"providers":{"tailscale":{"allow_tagged":true}}}`,
+		},
+		"allow_tagged false": {
+			input: `tailscale_auth {
+				allow_tagged false
+			}`,
+			want: `{"providers":{"tailscale":{}}}`,
+		},
+		"allowed_tags and deny_users": {
+			input: `tailscale_auth {
+				allowed_tags tag:ci tag:bot
+				deny_users mallory@example.com
+			}`,
+			want: `{"providers":{"tailscale":{"allowed_tags":["tag:ci","tag:bot"],"deny_users":["mallory@example.com"]}}}`,
+		},
+		"node and require_tailnet": {
+			input: `tailscale_auth {
+				node myhost
+				require_tailnet example.com
+			}`,
+			want: `{"providers":{"tailscale":{"node":"myhost","require_tailnet":"example.com"}}}`,
+		},
+		"capability": {
+			input: `tailscale_auth {
+				capability example.com/cap/grafana
+				require_capability
+			}`,
+			want: `{"providers":{"tailscale":{"capability":"example.com/cap/grafana","require_capability":true}}}`,
+		},
+		"cache_ttl": {
+			input: `tailscale_auth {
+				cache_ttl 30s
+			}`,
+			want: `{"providers":{"tailscale":{"cache_ttl":30000000000}}}`,
+		},
+		"allow_funnel": {
+			input: `tailscale_auth {
+				allow_funnel
+			}`,
+			want: `{"providers":{"tailscale":{"allow_funnel":true}}}`,
+		},
+		"forwarded identity": {
+			input: `tailscale_auth {
+				trusted_proxies proxy tag:proxy
+				forwarded_identity_secret {env.SECRET}
+			}`,
+			want: `{"providers":{"tailscale":{"trusted_proxies":["proxy","tag:proxy"],"forwarded_identity_secret":"{env.SECRET}"}}}`,
+		},
+		"missing trusted_proxies": {
+			input: `tailscale_auth {
+				trusted_proxies
+			}`,
+			wantErr: true,
+		},
+		"invalid cache_ttl": {
+			input: `tailscale_auth {
+				cache_ttl soon
+			}`,
+			wantErr: true,
+		},
+		"on_fail status": {
+			input: `tailscale_auth {
+				on_fail 403
+			}`,
+			want: `{"routes":[{"handle":[{"handler":"authentication","providers":{"tailscale":{}}}]}],` +
+				`"errors":{"routes":[` +
+				`{"match":[{"vars":{"{http.error.status_code}":["401"]}}],"handle":[{"handler":"static_response","status_code":403}]},` +
+				`{"handle":[{"error":"{http.error.message}","handler":"error","status_code":"{http.error.status_code}"}]}]}}`,
+		},
+		"on_fail redirect": {
+			input: `tailscale_auth {
+				on_fail redirect /login
+			}`,
+			want: `{"routes":[{"handle":[{"handler":"authentication","providers":{"tailscale":{}}}]}],` +
+				`"errors":{"routes":[` +
+				`{"match":[{"vars":{"{http.error.status_code}":["401"]}}],"handle":[{"handler":"static_response","status_code":302,"headers":{"Location":["/login"]}}]},` +
+				`{"handle":[{"error":"{http.error.message}","handler":"error","status_code":"{http.error.status_code}"}]}]}}`,
+		},
+		"on_fail invalid status": {
+			input: `tailscale_auth {
+				on_fail 200
+			}`,
+			wantErr: true,
+		},
+		"on_fail redirect missing url": {
+			input: `tailscale_auth {
+				on_fail redirect
+			}`,
+			wantErr: true,
+		},
+		"missing allowed_tags": {
+			input: `tailscale_auth {
+				allowed_tags
+			}`,
+			wantErr: true,
+		},
+		"unexpected argument": {
+			input:   `tailscale_auth foo`,
+			wantErr: true,
+		},
+		"unknown subdirective": {
+			input: `tailscale_auth {
+				foo
+			}`,
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(tt.input)}
+			got, err := parseAuthConfig(h)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAuthConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			gotJSON := string(caddyconfig.JSON(got, nil))
+			if diff := compareJSON(gotJSON, tt.want, t); diff != "" {
+				t.Errorf("parseAuthConfig() diff(-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_Authenticate(t *testing.T) {
+	user := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:         "laptop.example.ts.net.",
+			ComputedName: "laptop",
+			Hostinfo:     (&tailcfg.Hostinfo{Hostname: "laptop"}).View(),
+		},
+		UserProfile: &tailcfg.UserProfile{
+			LoginName:   "alice@example.com",
+			DisplayName: "Alice",
+		},
+		CapMap: tailcfg.PeerCapMap{
+			"example.com/cap/grafana": []tailcfg.RawMessage{
+				`{"role":"admin","orgs":["main","ops"],"limits":{"rps":10}}`,
+				`{"role":"editor","orgs":["main"]}`,
+			},
+		},
+	}
+	tagged := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:         "runner.example.ts.net.",
+			ComputedName: "runner",
+			Hostinfo:     (&tailcfg.Hostinfo{Hostname: "runner"}).View(),
+			Tags:         []string{"tag:ci", "tag:linux"},
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+	}
+
+	tests := map[string]struct {
+		auth     Auth
+		info     *apitype.WhoIsResponse
+		wantID   string
+		wantMeta map[string]string
+		wantErr  bool
+	}{
+		"user": {
+			info:   user,
+			wantID: "alice@example.com",
+			wantMeta: map[string]string{
+				"tailscale_login":   "alice",
+				"tailscale_user":    "alice@example.com",
+				"tailscale_name":    "Alice",
+				"tailscale_tailnet": "example.ts.net",
+				"tailscale_node":    "laptop.example.ts.net",
+				"tailscale_tags":    "",
+			},
+		},
+		"tagged node rejected by default": {
+			info:    tagged,
+			wantErr: true,
+		},
+		"tagged node allowed": {
+			auth:   Auth{AllowTagged: true},
+			info:   tagged,
+			wantID: "runner.example.ts.net",
+			wantMeta: map[string]string{
+				"tailscale_tailnet": "example.ts.net",
+				"tailscale_node":    "runner.example.ts.net",
+				"tailscale_tags":    "tag:ci,tag:linux",
+			},
+		},
+		"tagged node with allowed tag": {
+			auth:   Auth{AllowedTags: []string{"tag:bot", "tag:ci"}},
+			info:   tagged,
+			wantID: "runner.example.ts.net",
+		},
+		"tagged node without allowed tag": {
+			auth:    Auth{AllowTagged: true, AllowedTags: []string{"tag:bot"}},
+			info:    tagged,
+			wantErr: true,
+		},
+		"capability": {
+			auth:   Auth{Capability: "example.com/cap/grafana"},
+			info:   user,
+			wantID: "alice@example.com",
+			wantMeta: map[string]string{
+				"tailscale_cap":            `[{"role":"admin","orgs":["main","ops"],"limits":{"rps":10}},{"role":"editor","orgs":["main"]}]`,
+				"tailscale_cap.role":       "admin,editor",
+				"tailscale_cap.orgs":       "main,ops",
+				"tailscale_cap.limits.rps": "10",
+			},
+		},
+		"missing optional capability": {
+			auth:   Auth{AllowTagged: true, Capability: "example.com/cap/grafana"},
+			info:   tagged,
+			wantID: "runner.example.ts.net",
+			wantMeta: map[string]string{
+				"tailscale_cap": "",
+			},
+		},
+		"missing required capability": {
+			auth:    Auth{AllowTagged: true, Capability: "example.com/cap/grafana", RequireCapability: true},
+			info:    tagged,
+			wantErr: true,
+		},
+		"required tailnet": {
+			auth:   Auth{RequireTailnet: "example.ts.net"},
+			info:   user,
+			wantID: "alice@example.com",
+		},
+		"wrong tailnet": {
+			auth:    Auth{RequireTailnet: "other.ts.net"},
+			info:    user,
+			wantErr: true,
+		},
+		"denied user": {
+			auth:    Auth{DenyUsers: []string{"alice@example.com"}},
+			info:    user,
+			wantErr: true,
+		},
+		"denied tagged node": {
+			auth:    Auth{AllowTagged: true, DenyUsers: []string{"runner.example.ts.net"}},
+			info:    tagged,
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok, err := tt.auth.authenticate(tt.info)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ok == tt.wantErr {
+				t.Errorf("authenticate() ok = %v, want %v", ok, !tt.wantErr)
+			}
+			if got.ID != tt.wantID {
+				t.Errorf("authenticate() ID = %q, want %q", got.ID, tt.wantID)
+			}
+			for k, want := range tt.wantMeta {
+				if got.Metadata[k] != want {
+					t.Errorf("authenticate() Metadata[%q] = %q, want %q", k, got.Metadata[k], want)
+				}
+			}
+		})
+	}
+}
+
+func Test_AuthNodeReference(t *testing.T) {
+	must.Do(caddy.Run(new(caddy.Config)))
+	ctx := caddy.ActiveContext()
+
+	ta := &Auth{Node: "authnode"}
+	if err := ta.Provision(ctx); err != nil {
+		t.Fatal("failed to provision auth", err)
+	}
+
+	count, exists := nodes.References("authnode")
+	if !exists || count != 1 {
+		t.Fatalf("expected 1 node reference, got count=%d exists=%v", count, exists)
+	}
+
+	must.Do(ta.Cleanup())
+
+	count, exists = nodes.References("authnode")
+	if exists && count != 0 {
+		t.Fatalf("expected 0 node references after cleanup, got count=%d exists=%v", count, exists)
+	}
+}
+
+func Test_AddrIP(t *testing.T) {
+	tests := map[string]struct {
+		addr   net.Addr
+		want   netip.Addr
+		wantOK bool
+	}{
+		"nil": {},
+		"ipv4": {
+			addr:   &net.TCPAddr{IP: net.ParseIP("100.64.0.1"), Port: 443},
+			want:   netip.MustParseAddr("100.64.0.1"),
+			wantOK: true,
+		},
+		"ipv6": {
+			addr:   &net.TCPAddr{IP: net.ParseIP("fd7a:115c:a1e0::1"), Port: 443},
+			want:   netip.MustParseAddr("fd7a:115c:a1e0::1"),
+			wantOK: true,
+		},
+		"not an IP": {
+			addr: &net.UnixAddr{Name: "/tmp/caddy.sock", Net: "unix"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := addrIP(tt.addr)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("addrIP() = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func Test_LocalClientConnContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	ctx := localClientConnContext(context.Background(), c1)
+	lc, ok := ctx.Value(localClientCtxKey{}).(*local.Client)
+	if !ok || lc != tailscaledClient {
+		t.Fatalf("expected tailscaled client in conn context, got %v", lc)
+	}
+
+	// a second hook on the same connection keeps the resolved client
+	other := new(local.Client)
+	ctx = context.WithValue(ctx, localClientCtxKey{}, other)
+	if got := localClientConnContext(ctx, c1); got != ctx {
+		t.Error("expected conn context to be unchanged when client is already resolved")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	got, err := localClientForRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != other {
+		t.Errorf("localClientForRequest() = %v, want client from conn context", got)
+	}
+}
+
+// addrConn is a [net.Conn] with the given local address.
+type addrConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func Test_LocalClientConnContextService(t *testing.T) {
+	node := newTestNode(t, "authsvchost")
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// connections to a Tailscale Service have the service address as their local address,
+	// which is not one of the node's Tailscale IPs
+	vip := &net.TCPAddr{IP: net.ParseIP("100.100.0.1"), Port: 443}
+	c := &serviceConn{Conn: &addrConn{Conn: c1, local: vip}, node: node}
+	ctx := localClientConnContext(context.Background(), tls.Server(&countingConn{Conn: c}, &tls.Config{}))
+	lc, _ := ctx.Value(localClientCtxKey{}).(*local.Client)
+	if want := must.Get(node.LocalClient()); lc != want {
+		t.Errorf("conn context client = %v, want the client of the service's node", lc)
+	}
+
+	// without the service conn, the address is not recognized
+	ctx = localClientConnContext(context.Background(), &addrConn{Conn: c1, local: vip})
+	if lc, _ := ctx.Value(localClientCtxKey{}).(*local.Client); lc != tailscaledClient {
+		t.Errorf("conn context client = %v, want tailscaled client", lc)
+	}
+}
+
+func BenchmarkLocalClientForRequest(b *testing.B) {
+	localAddr := &net.TCPAddr{IP: net.ParseIP("100.64.0.1"), Port: 443}
+
+	b.Run("conn context", func(b *testing.B) {
+		ctx := context.WithValue(context.Background(), localClientCtxKey{}, tailscaledClient)
+		r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := localClientForRequest(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("local address", func(b *testing.B) {
+		ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, localAddr)
+		r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := localClientForRequest(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
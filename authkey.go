@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// authkey.go contains support for reading auth keys from files
+// and minting auth keys with OAuth client credentials.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/oauth2/clientcredentials"
+	"tailscale.com/client/tailscale"
+)
+
+// tailscaleAPIURL is the base URL of the Tailscale API used to mint auth keys.
+var tailscaleAPIURL = "https://api.tailscale.com"
+
+// mintedAuthKeyExpiry is how long a minted auth key is valid for.
+// Minted keys are used immediately to register a node, so they can be short-lived.
+const mintedAuthKeyExpiry = 10 * time.Minute
+
+// mintAuthKeyTimeout is the maximum time to wait for the Tailscale API when minting an auth key.
+const mintAuthKeyTimeout = 30 * time.Second
+
+// acknowledgeAPIOnce sets the acknowledgement required by tailscale.Client once,
+// since nodes may mint auth keys concurrently.
+var acknowledgeAPIOnce sync.Once
+
+// readAuthKeyFile reads an auth key from the file at path, which may contain placeholders.
+func readAuthKeyFile(path string) (string, error) {
+	path, err := repl.ReplaceOrErr(path, true, true)
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading auth key file: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// mintAuthKey uses the OAuth client credentials to create a new auth key for the named node.
+// The key is single use and pre-authorized, is ephemeral if the node is ephemeral,
+// and applies the node's tags, which are required when using OAuth clients.
+//
+// No key is minted for non-ephemeral nodes that have already been registered,
+// since their existing state is used to log in instead.
+func mintAuthKey(ctx context.Context, name string, app *App, clientID, clientSecret string) (string, error) {
+	tags := getTags(name, app)
+	if len(tags) == 0 {
+		return "", errors.New("tags are required to mint an auth key with OAuth client credentials")
+	}
+
+	ephemeral := getEphemeral(name, app)
+	if !ephemeral {
+		registered, err := isRegistered(ctx, name, app)
+		if err != nil {
+			return "", err
+		}
+		if registered {
+			app.logger.Debug("node is already registered, not minting auth key", zap.String("node", name))
+			return "", nil
+		}
+	}
+
+	clientID, err := repl.ReplaceOrErr(clientID, true, true)
+	if err != nil {
+		return "", err
+	}
+	clientSecret, err = repl.ReplaceOrErr(clientSecret, true, true)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mintAuthKeyTimeout)
+	defer cancel()
+
+	credentials := clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     tailscaleAPIURL + "/api/v2/oauth/token",
+	}
+
+	// tailscale.Client is only used to create auth keys, which is a stable API.
+	acknowledgeAPIOnce.Do(func() { tailscale.I_Acknowledge_This_API_Is_Unstable = true })
+	client := tailscale.NewClient("-", nil)
+	client.UserAgent = "caddy-tailscale"
+	client.HTTPClient = credentials.Client(ctx)
+	client.BaseURL = tailscaleAPIURL
+
+	caps := tailscale.KeyCapabilities{
+		Devices: tailscale.KeyDeviceCapabilities{
+			Create: tailscale.KeyDeviceCreateCapabilities{
+				Reusable:      false,
+				Ephemeral:     ephemeral,
+				Preauthorized: true,
+				Tags:          tags,
+			},
+		},
+	}
+
+	authKey, key, err := client.CreateKeyWithExpiry(ctx, caps, mintedAuthKeyExpiry)
+	if err != nil {
+		return "", fmt.Errorf("minting auth key: %w", err)
+	}
+	app.logger.Info("minted auth key", zap.String("node", name), zap.String("key_id", key.ID))
+	return authKey, nil
+}
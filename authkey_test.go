@@ -0,0 +1,212 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/client/tailscale"
+)
+
+func Test_GetAuthKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	nodeFile := filepath.Join(dir, "node")
+	appFile := filepath.Join(dir, "app")
+	os.WriteFile(nodeFile, []byte("tskey-node\n"), 0600)
+	os.WriteFile(appFile, []byte("tskey-app\n"), 0600)
+
+	tests := map[string]struct {
+		app     App
+		want    string
+		wantErr bool
+	}{
+		"app file": {
+			app:  App{AuthKeyFile: appFile},
+			want: "tskey-app",
+		},
+		"node file overrides app key": {
+			app: App{
+				DefaultAuthKey: "tskey-default",
+				Nodes:          map[string]Node{"host": {AuthKeyFile: nodeFile}},
+			},
+			want: "tskey-node",
+		},
+		"node key overrides node file": {
+			app: App{
+				Nodes: map[string]Node{"host": {AuthKey: "tskey-literal", AuthKeyFile: nodeFile}},
+			},
+			want: "tskey-literal",
+		},
+		"app key overrides app file": {
+			app:  App{DefaultAuthKey: "tskey-default", AuthKeyFile: appFile},
+			want: "tskey-default",
+		},
+		"missing file": {
+			app:     App{AuthKeyFile: filepath.Join(dir, "missing")},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := tt.app.Provision(caddy.Context{}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := getAuthKey(context.Background(), "host", &tt.app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getAuthKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getAuthKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeKeysAPI is a minimal Tailscale API server that issues OAuth tokens and creates auth keys.
+type fakeKeysAPI struct {
+	clientID, clientSecret string
+
+	// created is the capabilities of each created key.
+	created []tailscale.KeyCapabilities
+}
+
+func (f *fakeKeysAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/v2/oauth/token":
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != f.clientID || secret != f.clientSecret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"Bearer","expires_in":3600}`))
+	case "/api/v2/tailnet/-/keys":
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Capabilities tailscale.KeyCapabilities `json:"capabilities"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.created = append(f.created, req.Capabilities)
+		w.Write([]byte(`{"id":"k123","key":"tskey-auth-minted"}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func Test_MintAuthKey(t *testing.T) {
+	api := &fakeKeysAPI{clientID: "client-id", clientSecret: "tskey-client-secret"}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	oldURL := tailscaleAPIURL
+	tailscaleAPIURL = srv.URL
+	defer func() { tailscaleAPIURL = oldURL }()
+
+	registered := t.TempDir()
+	os.WriteFile(filepath.Join(registered, "tailscaled.state"), []byte("{}"), 0600)
+
+	tests := map[string]struct {
+		app      App
+		want     string
+		wantCaps *tailscale.KeyDeviceCreateCapabilities
+		wantErr  bool
+	}{
+		"app credentials": {
+			app: App{
+				OAuthClientID:     "client-id",
+				OAuthClientSecret: "tskey-client-secret",
+				Tags:              []string{"tag:caddy"},
+				StateDir:          t.TempDir(),
+			},
+			want: "tskey-auth-minted",
+			wantCaps: &tailscale.KeyDeviceCreateCapabilities{
+				Preauthorized: true,
+				Tags:          []string{"tag:caddy"},
+			},
+		},
+		"node credentials override app key": {
+			app: App{
+				DefaultAuthKey: "tskey-default",
+				Ephemeral:      true,
+				Nodes: map[string]Node{"host": {
+					OAuthClientID:     "client-id",
+					OAuthClientSecret: "tskey-client-secret",
+					Tags:              []string{"tag:web"},
+				}},
+			},
+			want: "tskey-auth-minted",
+			wantCaps: &tailscale.KeyDeviceCreateCapabilities{
+				Ephemeral:     true,
+				Preauthorized: true,
+				Tags:          []string{"tag:web"},
+			},
+		},
+		"already registered": {
+			app: App{
+				OAuthClientID:     "client-id",
+				OAuthClientSecret: "tskey-client-secret",
+				Tags:              []string{"tag:caddy"},
+				Nodes:             map[string]Node{"host": {StateDir: registered}},
+			},
+			want: "",
+		},
+		"missing tags": {
+			app: App{
+				OAuthClientID:     "client-id",
+				OAuthClientSecret: "tskey-client-secret",
+			},
+			wantErr: true,
+		},
+		"invalid credentials": {
+			app: App{
+				OAuthClientID:     "client-id",
+				OAuthClientSecret: "tskey-client-wrong",
+				Tags:              []string{"tag:caddy"},
+				Ephemeral:         true,
+			},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			api.created = nil
+			if err := tt.app.Provision(caddy.Context{}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := getAuthKey(context.Background(), "host", &tt.app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getAuthKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getAuthKey() = %q, want %q", got, tt.want)
+			}
+			if tt.wantCaps == nil {
+				if len(api.created) != 0 {
+					t.Errorf("expected no keys to be created, got %v", api.created)
+				}
+				return
+			}
+			if len(api.created) != 1 {
+				t.Fatalf("expected 1 key to be created, got %d", len(api.created))
+			}
+			if diff := cmp.Diff(api.created[0].Devices.Create, *tt.wantCaps); diff != "" {
+				t.Errorf("created key capabilities diff(-got +want):\n%s", diff)
+			}
+		})
+	}
+}
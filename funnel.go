@@ -0,0 +1,227 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// funnel.go contains support for exposing listeners to the public internet with Tailscale Funnel.
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"tailscale.com/ipn"
+	"tailscale.com/util/mak"
+)
+
+// funnelPorts are the ports that Tailscale Funnel supports.
+var funnelPorts = []string{"443", "8443", "10000"}
+
+// funnelCtxKey is the context key for whether a connection arrived over Funnel.
+// It is set on the connection context by [funnelConnContext].
+type funnelCtxKey struct{}
+
+// funnelPlaceholder is the placeholder that is set to whether a request arrived over Funnel.
+// Caddy has no hook to set placeholders for every request,
+// so it is only set by [isFunnelRequest] when a module of this package handles the request.
+const funnelPlaceholder = "tailscale.funnel"
+
+// listenFunnel listens on the port of the node for connections from both the tailnet
+// and the public internet through Tailscale Funnel.
+// Unlike [tsnet.Server.ListenFunnel], connections are not TLS terminated,
+// so that Caddy can serve TLS with the node's certificate like any other listener.
+func listenFunnel(node *tailscaleNode, _, network, port string) (net.Listener, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("funnel only supports tcp, not %s", network)
+	}
+	if !slices.Contains(funnelPorts, port) {
+		return nil, fmt.Errorf("funnel only supports ports %v, not %s", funnelPorts, port)
+	}
+
+	// ListenFunnel waits for the node to be running without a timeout,
+	// so wait for it first even if the node is not configured to wait for running.
+	if err := node.waitRunning(context.Background(), node.name, cmp.Or(node.runningTimeout, node.startupTimeout)); err != nil {
+		return nil, err
+	}
+
+	// ListenFunnel resets the serve config of the node, removing any other Funnel ports
+	// and Tailscale Services the node is listening on, so they are set again before any other edit.
+	serveConfigMu.Lock()
+	defer serveConfigMu.Unlock()
+	ln, err := node.ListenFunnel(network, ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	if err := services.reapply(node); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := funnels.add(node, port); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &funnelListener{Listener: ln, node: node, port: port}, nil
+}
+
+// listenTCPOrFunnel listens on the port of the node,
+// using Funnel if it is enabled for the node and the port is supported by Funnel.
+func listenTCPOrFunnel(node *tailscaleNode, host, network, port string) (net.Listener, error) {
+	if node.funnel && network == "tcp" && slices.Contains(funnelPorts, port) {
+		return listenFunnel(node, host, network, port)
+	}
+	return listenTCP(node, host, network, port)
+}
+
+// funnelListener is a [net.Listener] returned by [tsnet.Server.ListenFunnel]
+// that returns the underlying connections, rather than TLS connections.
+type funnelListener struct {
+	net.Listener
+	node *tailscaleNode
+	port string
+}
+
+func (l *funnelListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// The TLS connection is created by the listener without any I/O,
+	// so its underlying connection can be used directly.
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if fc, ok := c.(*ipn.FunnelConn); ok {
+		return &funnelConn{FunnelConn: fc}, nil
+	}
+	return c, nil
+}
+
+func (l *funnelListener) Close() error {
+	funnels.remove(l.node, l.port)
+	return l.Listener.Close()
+}
+
+// funnelConn is a connection that arrived over Funnel.
+// Its remote address is the address of the client on the public internet,
+// rather than the address of the Funnel relay that forwarded it.
+type funnelConn struct {
+	*ipn.FunnelConn
+}
+
+func (c *funnelConn) RemoteAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.Src)
+}
+
+// funnels tracks the Funnel ports that nodes are listening on.
+var funnels = &funnelRegistry{ports: make(map[*tailscaleNode][]string)}
+
+type funnelRegistry struct {
+	mu    sync.Mutex
+	ports map[*tailscaleNode][]string
+}
+
+// add adds port to the Funnel ports of node, and allows Funnel on all of them in the node's serve config.
+// If the serve config cannot be updated, port is not added.
+// serveConfigMu must be held.
+func (f *funnelRegistry) add(node *tailscaleNode, port string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if slices.Contains(f.ports[node], port) {
+		return f.updateLocked(node)
+	}
+	f.ports[node] = append(f.ports[node], port)
+	if err := f.updateLocked(node); err != nil {
+		f.ports[node] = slices.DeleteFunc(f.ports[node], func(p string) bool { return p == port })
+		if len(f.ports[node]) == 0 {
+			delete(f.ports, node)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove removes port from the Funnel ports of node, and disallows Funnel on it in the node's serve config.
+func (f *funnelRegistry) remove(node *tailscaleNode, port string) {
+	serveConfigMu.Lock()
+	defer serveConfigMu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ports[node] = slices.DeleteFunc(f.ports[node], func(p string) bool { return p == port })
+	if len(f.ports[node]) == 0 {
+		delete(f.ports, node)
+	}
+	_ = f.updateLocked(node)
+}
+
+// updateLocked sets the Funnel ports allowed in the node's serve config to the node's Funnel ports.
+// serveConfigMu and f.mu must be held.
+func (f *funnelRegistry) updateLocked(node *tailscaleNode) error {
+	if !node.started() {
+		return nil
+	}
+	lc, err := node.LocalClient()
+	if err != nil {
+		return err
+	}
+	domains := node.CertDomains()
+	if len(domains) == 0 {
+		return nil
+	}
+
+	ports := f.ports[node]
+	return editServeConfigLocked(context.Background(), lc, func(sc *ipn.ServeConfig) {
+		sc.AllowFunnel = nil
+		for _, port := range ports {
+			mak.Set(&sc.AllowFunnel, ipn.HostPort(domains[0]+":"+port), true)
+		}
+	})
+}
+
+// registerFunnelConnContext registers a ConnContext hook on the caddy HTTP server being provisioned,
+// so that whether each connection arrived over Funnel is known to request handlers.
+func registerFunnelConnContext(ctx caddy.Context) {
+	if server, ok := ctx.Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok && server != nil {
+		server.RegisterConnContext(funnelConnContext)
+	}
+}
+
+// funnelConnContext stores whether c arrived over Funnel in the connection context.
+func funnelConnContext(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := ctx.Value(funnelCtxKey{}).(bool); ok {
+		// already resolved by another module on the same server
+		return ctx
+	}
+	return context.WithValue(ctx, funnelCtxKey{}, isFunnelConn(c))
+}
+
+// isFunnelConn reports whether c, or any connection it wraps, arrived over Funnel.
+func isFunnelConn(c net.Conn) bool {
+	for c != nil {
+		switch cc := c.(type) {
+		case *funnelConn, *ipn.FunnelConn:
+			return true
+		case interface{ NetConn() net.Conn }:
+			c = cc.NetConn()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// isFunnelRequest reports whether r arrived over Funnel,
+// and sets the {tailscale.funnel} placeholder accordingly.
+func isFunnelRequest(r *http.Request) bool {
+	funnel, _ := r.Context().Value(funnelCtxKey{}).(bool)
+	if replacer, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		replacer.Set(funnelPlaceholder, funnel)
+	}
+	return funnel
+}
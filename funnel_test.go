@@ -0,0 +1,187 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"tailscale.com/ipn"
+	"tailscale.com/tsnet"
+	"tailscale.com/util/must"
+)
+
+// fakeListener is a [net.Listener] that returns conns sent on its channel.
+type fakeListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func (l *fakeListener) Close() error {
+	return nil
+}
+
+func Test_FunnelListener(t *testing.T) {
+	src := netip.MustParseAddrPort("203.0.113.1:1234")
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// ListenFunnel returns TLS connections over FunnelConns for connections from Funnel,
+	// and over plain connections for connections from the tailnet.
+	inner := &fakeListener{conns: make(chan net.Conn, 2)}
+	inner.conns <- tls.Server(&ipn.FunnelConn{Conn: c1, Src: src}, &tls.Config{})
+	inner.conns <- tls.Server(c2, &tls.Config{})
+
+	ln := &funnelListener{
+		Listener: inner,
+		node:     &tailscaleNode{Server: new(tsnet.Server)},
+		port:     "443",
+	}
+	defer ln.Close()
+
+	c := must.Get(ln.Accept())
+	if _, ok := c.(*funnelConn); !ok {
+		t.Fatalf("Accept() = %T, want *funnelConn", c)
+	}
+	if got := c.RemoteAddr().String(); got != src.String() {
+		t.Errorf("RemoteAddr() = %v, want %v", got, src)
+	}
+	if !isFunnelConn(c) {
+		t.Error("isFunnelConn(funnel conn) = false, want true")
+	}
+
+	c = must.Get(ln.Accept())
+	if c != c2 {
+		t.Errorf("Accept() = %T, want the underlying tailnet conn", c)
+	}
+	if isFunnelConn(c) {
+		t.Error("isFunnelConn(tailnet conn) = true, want false")
+	}
+}
+
+func Test_IsFunnelConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	funnel := &funnelConn{FunnelConn: &ipn.FunnelConn{Conn: c1}}
+	tests := map[string]struct {
+		conn net.Conn
+		want bool
+	}{
+		"plain":               {conn: c2, want: false},
+		"funnel":              {conn: funnel, want: true},
+		"counted funnel":      {conn: &countingConn{Conn: funnel}, want: true},
+		"tls over funnel":     {conn: tls.Server(&countingConn{Conn: funnel}, &tls.Config{}), want: true},
+		"tls over plain conn": {conn: tls.Server(&countingConn{Conn: c2}, &tls.Config{}), want: false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := isFunnelConn(tt.conn); got != tt.want {
+				t.Errorf("isFunnelConn() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ListenFunnelValidation(t *testing.T) {
+	if _, err := listenFunnel(nil, "", "tcp", "80"); err == nil {
+		t.Error("listenFunnel() on port 80 succeeded, want error")
+	}
+	if _, err := listenFunnel(nil, "", "tcp4", "443"); err == nil {
+		t.Error("listenFunnel() on tcp4 succeeded, want error")
+	}
+}
+
+func Test_ListenFunnelKeepsServices(t *testing.T) {
+	node := newTestNode(t, "funnelhost")
+
+	sln, err := listenService(node, "svc:web", "tcp", "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sln.Close()
+	// binding a Funnel listener resets the node's serve config
+	fln, err := listenFunnel(node, "", "tcp", "443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fln.Close()
+
+	lc := must.Get(node.LocalClient())
+	sc := must.Get(lc.GetServeConfig(context.Background()))
+	if !sc.AllowFunnel["funnelhost.tail-scale.ts.net:443"] {
+		t.Errorf("AllowFunnel = %v, want funnelhost.tail-scale.ts.net:443", sc.AllowFunnel)
+	}
+	if svc := sc.Services["svc:web"]; svc == nil || svc.TCP[80] == nil {
+		t.Errorf("Services = %v, want svc:web on port 80", sc.Services)
+	}
+}
+
+// funnelRequest returns a request with a replacer, as if it arrived over Funnel if funnel is true.
+func funnelRequest(funnel bool) (*http.Request, *caddy.Replacer) {
+	repl := caddy.NewReplacer()
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, funnelCtxKey{}, funnel)
+	return httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil), repl
+}
+
+func Test_AuthenticateFunnel(t *testing.T) {
+	tests := map[string]struct {
+		allowFunnel bool
+		wantAuthed  bool
+		wantErr     bool
+	}{
+		"rejected by default": {wantErr: true},
+		"anonymous":           {allowFunnel: true, wantAuthed: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r, repl := funnelRequest(true)
+			ta := &Auth{AllowFunnel: tt.allowFunnel}
+			user, authed, err := ta.Authenticate(httptest.NewRecorder(), r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if authed != tt.wantAuthed {
+				t.Errorf("Authenticate() authed = %v, want %v", authed, tt.wantAuthed)
+			}
+			if authed && user.ID != "" {
+				t.Errorf("Authenticate() user ID = %q, want anonymous", user.ID)
+			}
+			if v, _ := repl.Get(funnelPlaceholder); v != true {
+				t.Errorf("{%s} = %v, want true", funnelPlaceholder, v)
+			}
+		})
+	}
+}
+
+func Test_MatchFunnel(t *testing.T) {
+	r, repl := funnelRequest(true)
+	m := MatchTailscale{Users: []string{"alice@example.com"}}
+	match, err := m.MatchWithError(r)
+	if err != nil || match {
+		t.Errorf("MatchWithError() = %v, %v, want false, nil", match, err)
+	}
+	if v, _ := repl.Get(funnelPlaceholder); v != true {
+		t.Errorf("{%s} = %v, want true", funnelPlaceholder, v)
+	}
+
+	r, repl = funnelRequest(false)
+	isFunnelRequest(r)
+	if v, _ := repl.Get(funnelPlaceholder); v != false {
+		t.Errorf("{%s} = %v, want false", funnelPlaceholder, v)
+	}
+}
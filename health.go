@@ -0,0 +1,140 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// health.go contains the Health handler, which reports whether a Tailscale node is running.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"tailscale.com/ipn"
+)
+
+func init() {
+	caddy.RegisterModule(Health{})
+	httpcaddyfile.RegisterHandlerDirective("tailscale_health", parseHealthConfig)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_health", httpcaddyfile.Before, "respond")
+}
+
+// healthStatusTimeout is the maximum time to wait for the status of a node when checking its health.
+const healthStatusTimeout = 5 * time.Second
+
+// Health is an HTTP handler that reports whether a Tailscale node is running,
+// for use by load balancers and container orchestrators.
+// It responds with 200 OK if the node is running, and 503 Service Unavailable otherwise,
+// such as while the node is starting or needs to be logged in.
+// The node is started when the handler is provisioned, so it can be used without any listener on the node.
+//
+// For example, in a Caddyfile:
+//
+//	handle /healthz {
+//	  tailscale_health myapp
+//	}
+type Health struct {
+	// Node is the name of the Tailscale node to report on.
+	Node string `json:"node,omitempty"`
+
+	node *tailscaleNode
+}
+
+// healthResponse is the body of a Health response.
+type healthResponse struct {
+	Node         string `json:"node"`
+	BackendState string `json:"backend_state"`
+}
+
+func (Health) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_health",
+		New: func() caddy.Module { return new(Health) },
+	}
+}
+
+func (h *Health) Provision(ctx caddy.Context) error {
+	if h.Node == "" {
+		return errors.New("node is required")
+	}
+	node, err := getNode(ctx, h.Node)
+	if err != nil {
+		return err
+	}
+	// Start the node, so that its health is reported even if nothing else uses it.
+	if err := node.start(); err != nil {
+		_, _ = nodes.Delete(h.Node)
+		return fmt.Errorf("starting tailscale node %s: %w", h.Node, err)
+	}
+	h.node = node
+	return nil
+}
+
+func (h *Health) Cleanup() error {
+	_ = releaseNode(h.Node, h.node)
+	return nil
+}
+
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	resp := healthResponse{
+		Node:         h.Node,
+		BackendState: h.backendState(r.Context()),
+	}
+
+	status := http.StatusOK
+	if resp.BackendState != ipn.Running.String() {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// backendState returns the backend state of the node, such as "Running" or "NeedsLogin".
+// Nodes whose status cannot be retrieved, are reported as "NoState".
+func (h *Health) backendState(ctx context.Context) string {
+	if h.node == nil {
+		return ipn.NoState.String()
+	}
+	lc, err := h.node.LocalClient()
+	if err != nil {
+		return ipn.NoState.String()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthStatusTimeout)
+	defer cancel()
+	st, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		return ipn.NoState.String()
+	}
+	return st.BackendState
+}
+
+func parseHealthConfig(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var th Health
+
+	h.Next() // skip directive name
+	if !h.NextArg() {
+		return nil, h.ArgErr()
+	}
+	th.Node = h.Val()
+	if h.NextArg() {
+		return nil, h.ArgErr()
+	}
+
+	return &th, nil
+}
+
+var (
+	_ caddy.Provisioner           = (*Health)(nil)
+	_ caddy.CleanerUpper          = (*Health)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Health)(nil)
+)
@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"tailscale.com/util/must"
+)
+
+func Test_ParseHealthConfig(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		"node": {
+			input: `tailscale_health myapp`,
+			want:  "myapp",
+		},
+		"missing node": {
+			input:   `tailscale_health`,
+			wantErr: true,
+		},
+		"too many args": {
+			input:   `tailscale_health myapp other`,
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(tt.input)}
+			got, err := parseHealthConfig(h)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHealthConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if node := got.(*Health).Node; node != tt.want {
+				t.Errorf("parseHealthConfig() node = %q, want %q", node, tt.want)
+			}
+		})
+	}
+}
+
+func Test_HealthStartsNode(t *testing.T) {
+	must.Do(caddy.Run(new(caddy.Config)))
+	ctx := caddy.ActiveContext()
+
+	h := &Health{Node: "healthnode"}
+	must.Do(h.Provision(ctx))
+	defer h.Cleanup()
+
+	// the node is started, even though nothing else uses it
+	if !h.node.started() {
+		t.Fatal("node is not started after Provision")
+	}
+
+	w := httptest.NewRecorder()
+	must.Do(h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil), nil))
+
+	// the node is not logged in, so is not running
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("ServeHTTP() status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	var got healthResponse
+	must.Do(json.Unmarshal(w.Body.Bytes(), &got))
+	if got.Node != "healthnode" || got.BackendState == "Running" {
+		t.Errorf("ServeHTTP() body = %+v, want a healthnode that is not running", got)
+	}
+}
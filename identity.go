@@ -0,0 +1,171 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// identity.go contains the signed identity header that proxies use to forward
+// the Tailscale identity of their clients to upstreams on the tailnet.
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// identityHeader is the request header that carries a forwarded identity.
+const identityHeader = "Tailscale-Identity"
+
+// identityTTL is how long a forwarded identity is valid after it is signed.
+const identityTTL = time.Minute
+
+// identityJWSHeader is the protected header of forwarded identities,
+// which are JSON Web Signatures in compact serialization, signed with HMAC SHA-256.
+var identityJWSHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// identityIssuer is the proxy node that signs forwarded identities.
+type identityIssuer struct {
+	ID   tailcfg.StableNodeID // the stable ID of the node
+	Name string               // the fully qualified name of the node
+}
+
+// identityClaims is the payload of a forwarded identity.
+// It holds the parts of the WhoIs response of the client that are used to authenticate it.
+type identityClaims struct {
+	// Issuer and IssuerID are the fully qualified name and stable ID of the proxy node that signed the identity.
+	Issuer   string               `json:"iss"`
+	IssuerID tailcfg.StableNodeID `json:"iss_id"`
+	IssuedAt int64                `json:"iat"`
+	Expiry   int64                `json:"exp"`
+
+	NodeName      string             `json:"node"`
+	ComputedName  string             `json:"computed_name,omitempty"`
+	Hostname      string             `json:"hostname,omitempty"`
+	Sharee        bool               `json:"sharee,omitempty"`
+	Tags          []string           `json:"tags,omitempty"`
+	LoginName     string             `json:"login_name,omitempty"`
+	DisplayName   string             `json:"display_name,omitempty"`
+	ProfilePicURL string             `json:"profile_pic_url,omitempty"`
+	CapMap        tailcfg.PeerCapMap `json:"cap_map,omitempty"`
+}
+
+// newIdentityClaims returns the claims for forwarding the identity info, signed by issuer at now.
+func newIdentityClaims(info *apitype.WhoIsResponse, issuer identityIssuer, now time.Time) identityClaims {
+	c := identityClaims{
+		Issuer:       issuer.Name,
+		IssuerID:     issuer.ID,
+		IssuedAt:     now.Unix(),
+		Expiry:       now.Add(identityTTL).Unix(),
+		NodeName:     info.Node.Name,
+		ComputedName: info.Node.ComputedName,
+		Tags:         info.Node.Tags,
+		CapMap:       info.CapMap,
+	}
+	if info.Node.Hostinfo.Valid() {
+		c.Hostname = info.Node.Hostinfo.Hostname()
+		c.Sharee = info.Node.Hostinfo.ShareeNode()
+	}
+	if info.UserProfile != nil {
+		c.LoginName = info.UserProfile.LoginName
+		c.DisplayName = info.UserProfile.DisplayName
+		c.ProfilePicURL = info.UserProfile.ProfilePicURL
+	}
+	return c
+}
+
+// whoIs returns the WhoIs response of the forwarded identity.
+func (c identityClaims) whoIs() *apitype.WhoIsResponse {
+	return &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:         c.NodeName,
+			ComputedName: c.ComputedName,
+			Tags:         c.Tags,
+			Hostinfo:     (&tailcfg.Hostinfo{Hostname: c.Hostname, ShareeNode: c.Sharee}).View(),
+		},
+		UserProfile: &tailcfg.UserProfile{
+			LoginName:     c.LoginName,
+			DisplayName:   c.DisplayName,
+			ProfilePicURL: c.ProfilePicURL,
+		},
+		CapMap: c.CapMap,
+	}
+}
+
+// identityKey derives the key that the proxy node issuer signs forwarded identities with from secret,
+// so that an identity signed by one proxy cannot be replayed through another,
+// even one that later takes over the name of the proxy.
+func identityKey(secret string, issuer identityIssuer) ([]byte, error) {
+	if issuer.ID == "" || issuer.Name == "" {
+		return nil, errors.New("identity issuer has no node ID or name")
+	}
+	info := "caddy-tailscale identity " + string(issuer.ID) + " " + strings.ToLower(strings.TrimSuffix(issuer.Name, "."))
+	return hkdf.Key(sha256.New, []byte(secret), nil, info, sha256.Size)
+}
+
+// signIdentity returns the forwarded identity for claims, signed with key.
+func signIdentity(claims identityClaims, key []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := identityJWSHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyIdentity verifies that the forwarded identity token was signed with key by the proxy node issuer,
+// and has not expired at now, and returns its claims.
+func verifyIdentity(token string, key []byte, issuer identityIssuer, now time.Time) (identityClaims, error) {
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != identityJWSHeader {
+		return identityClaims{}, errors.New("malformed identity: unsupported header")
+	}
+	payload, sig, ok := strings.Cut(rest, ".")
+	if !ok {
+		return identityClaims{}, errors.New("malformed identity: missing signature")
+	}
+
+	gotMAC, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return identityClaims{}, fmt.Errorf("malformed identity signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(header + "." + payload))
+	if !hmac.Equal(gotMAC, mac.Sum(nil)) {
+		return identityClaims{}, errors.New("invalid identity signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return identityClaims{}, fmt.Errorf("malformed identity payload: %w", err)
+	}
+	var claims identityClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return identityClaims{}, fmt.Errorf("malformed identity payload: %w", err)
+	}
+
+	if claims.IssuerID == "" || claims.IssuerID != issuer.ID ||
+		!strings.EqualFold(strings.TrimSuffix(claims.Issuer, "."), strings.TrimSuffix(issuer.Name, ".")) {
+		return identityClaims{}, fmt.Errorf("identity was issued by %s (%s), not %s (%s)",
+			claims.Issuer, claims.IssuerID, issuer.Name, issuer.ID)
+	}
+	if now.Unix() >= claims.Expiry {
+		return identityClaims{}, errors.New("identity has expired")
+	}
+	if claims.IssuedAt > now.Add(identityTTL).Unix() {
+		return identityClaims{}, errors.New("identity was issued in the future")
+	}
+	if claims.NodeName == "" {
+		return identityClaims{}, errors.New("identity has no node")
+	}
+	return claims, nil
+}
@@ -0,0 +1,212 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/must"
+)
+
+func Test_VerifyIdentity(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	info := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:         "laptop.example.ts.net.",
+			ComputedName: "laptop",
+			Hostinfo:     (&tailcfg.Hostinfo{Hostname: "laptop"}).View(),
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice"},
+		CapMap: tailcfg.PeerCapMap{
+			"example.com/cap/grafana": []tailcfg.RawMessage{`{"role":"admin"}`},
+		},
+	}
+	issuer := identityIssuer{ID: "nproxy", Name: "proxy.example.ts.net."}
+	key := must.Get(identityKey("secret", issuer))
+	token := must.Get(signIdentity(newIdentityClaims(info, issuer, now), key))
+
+	other := identityIssuer{ID: "nother", Name: "other.example.ts.net."}
+	otherKey := must.Get(identityKey("secret", other))
+	// a node that took over the name of the proxy
+	renamed := identityIssuer{ID: "nrenamed", Name: issuer.Name}
+	renamedKey := must.Get(identityKey("secret", renamed))
+
+	if _, err := identityKey("secret", identityIssuer{Name: issuer.Name}); err == nil {
+		t.Error("identityKey() without a node ID succeeded, want error")
+	}
+	header, rest, _ := strings.Cut(token, ".")
+	payload, sig, _ := strings.Cut(rest, ".")
+
+	tests := map[string]struct {
+		token   string
+		key     []byte
+		issuer  identityIssuer
+		now     time.Time
+		wantErr bool
+	}{
+		"valid": {
+			token:  token,
+			key:    key,
+			issuer: identityIssuer{ID: "nproxy", Name: "Proxy.example.ts.net"},
+			now:    now.Add(30 * time.Second),
+		},
+		"expired": {
+			token:   token,
+			key:     key,
+			issuer:  issuer,
+			now:     now.Add(identityTTL),
+			wantErr: true,
+		},
+		"issued in the future": {
+			token:   token,
+			key:     key,
+			issuer:  issuer,
+			now:     now.Add(-2 * identityTTL),
+			wantErr: true,
+		},
+		"other proxy": {
+			token:   token,
+			key:     otherKey,
+			issuer:  other,
+			now:     now,
+			wantErr: true,
+		},
+		"other issuer with same key": {
+			token:   token,
+			key:     key,
+			issuer:  other,
+			now:     now,
+			wantErr: true,
+		},
+		"other node with the proxy's name": {
+			token:   token,
+			key:     renamedKey,
+			issuer:  renamed,
+			now:     now,
+			wantErr: true,
+		},
+		"other node ID with same key": {
+			token:   token,
+			key:     key,
+			issuer:  renamed,
+			now:     now,
+			wantErr: true,
+		},
+		"tampered payload": {
+			token:   header + "." + payload + "e30." + sig,
+			key:     key,
+			issuer:  issuer,
+			now:     now,
+			wantErr: true,
+		},
+		"unsigned": {
+			token:   header + "." + payload + ".",
+			key:     key,
+			issuer:  issuer,
+			now:     now,
+			wantErr: true,
+		},
+		"other algorithm": {
+			token:   "eyJhbGciOiJub25lIn0." + payload + "." + sig,
+			key:     key,
+			issuer:  issuer,
+			now:     now,
+			wantErr: true,
+		},
+		"malformed": {
+			token:   "garbage",
+			key:     key,
+			issuer:  issuer,
+			now:     now,
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			claims, err := verifyIdentity(tt.token, tt.key, tt.issuer, tt.now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyIdentity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			got := claims.whoIs()
+			if got.Node.Name != info.Node.Name || got.Node.ComputedName != info.Node.ComputedName ||
+				got.Node.Hostinfo.Hostname() != "laptop" {
+				t.Errorf("whoIs().Node = %+v, want %+v", got.Node, info.Node)
+			}
+			if diff := cmp.Diff(got.UserProfile, info.UserProfile); diff != "" {
+				t.Errorf("whoIs().UserProfile diff(-got +want):\n%s", diff)
+			}
+			if diff := cmp.Diff(got.CapMap, info.CapMap); diff != "" {
+				t.Errorf("whoIs().CapMap diff(-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_AuthForwardedIdentity(t *testing.T) {
+	now := time.Now()
+	proxy := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			StableID:     "nproxy",
+			Name:         "proxy.example.ts.net.",
+			ComputedName: "proxy",
+			Tags:         []string{"tag:proxy"},
+		},
+	}
+	user := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:         "laptop.example.ts.net.",
+			ComputedName: "laptop",
+			Hostinfo:     (&tailcfg.Hostinfo{Hostname: "laptop"}).View(),
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice"},
+	}
+	issuer := identityIssuer{ID: proxy.Node.StableID, Name: proxy.Node.Name}
+	key := must.Get(identityKey("secret", issuer))
+	token := must.Get(signIdentity(newIdentityClaims(user, issuer, now), key))
+
+	for _, trusted := range []string{"proxy", "proxy.example.ts.net", "tag:proxy"} {
+		ta := &Auth{TrustedProxies: []string{trusted}, identitySecret: "secret"}
+		if !ta.isTrustedProxy(proxy) {
+			t.Errorf("isTrustedProxy() with trusted_proxies %s = false, want true", trusted)
+		}
+		if ta.isTrustedProxy(user) {
+			t.Errorf("isTrustedProxy(user) with trusted_proxies %s = true, want false", trusted)
+		}
+	}
+
+	ta := &Auth{TrustedProxies: []string{"tag:proxy"}, identitySecret: "secret"}
+	info, err := ta.forwardedIdentity(token, proxy, now)
+	if err != nil {
+		t.Fatalf("forwardedIdentity() error = %v", err)
+	}
+	u, ok, err := ta.authenticate(info)
+	if err != nil || !ok {
+		t.Fatalf("authenticate() = %v, %v", ok, err)
+	}
+	if u.ID != "alice@example.com" || u.Metadata["tailscale_node"] != "laptop.example.ts.net" ||
+		u.Metadata["tailscale_tailnet"] != "example.ts.net" {
+		t.Errorf("authenticate() = %+v", u)
+	}
+
+	wrongSecret := &Auth{TrustedProxies: []string{"tag:proxy"}, identitySecret: "other"}
+	if _, err := wrongSecret.forwardedIdentity(token, proxy, now); err == nil {
+		t.Error("forwardedIdentity() with wrong secret succeeded, want error")
+	}
+
+	// a node that took over the name and tags of the proxy did not sign the identity
+	impostor := &apitype.WhoIsResponse{Node: proxy.Node.Clone()}
+	impostor.Node.StableID = "nimpostor"
+	if _, err := ta.forwardedIdentity(token, impostor, now); err == nil {
+		t.Error("forwardedIdentity() from another node with the proxy's name succeeded, want error")
+	}
+}
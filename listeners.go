@@ -0,0 +1,249 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// listeners.go contains the registry of Tailscale networks that Caddy can listen on.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// tailscaleNetwork is a Tailscale network that Caddy can listen on, such as "tailscale".
+// Each network only declares how to bind a listener on a node;
+// parsing addresses, pooling listeners, and counting node references is shared by all networks.
+//
+// Exactly one of listen or listenPacket must be set.
+type tailscaleNetwork struct {
+	// name is the Caddy network name, such as "tailscale" in "tailscale/myhost:80".
+	// It is also the prefix of the keys of the network's listeners.
+	name string
+
+	// defaultNetwork is the network used to listen on the node
+	// if the address does not specify one, such as "tcp" or "udp".
+	defaultNetwork string
+
+	// http3Network is the network that HTTP/3 is served on
+	// for HTTP servers listening on this network, if any.
+	http3Network string
+
+	// nodeName optionally returns the name of the node that listens for the host of an address.
+	// By default, the host is the name of the node.
+	nodeName func(host string, app *App) (string, error)
+
+	// listen returns a stream listener for the host on the node.
+	listen func(node *tailscaleNode, host, network, port string) (net.Listener, error)
+
+	// wrap optionally wraps the listener returned by listen,
+	// after its connections are counted for metrics.
+	wrap func(node *tailscaleNode, ln net.Listener) (net.Listener, error)
+
+	// listenPacket returns a packet conn on the node.
+	listenPacket func(node *tailscaleNode, name, network, port string) (net.PacketConn, error)
+}
+
+// tailscaleNetworks are the Tailscale networks registered with Caddy.
+var tailscaleNetworks = []*tailscaleNetwork{
+	{
+		name:           "tailscale",
+		defaultNetwork: "tcp",
+		http3Network:   "tailscale/udp",
+		listen:         listenTCPOrFunnel,
+	},
+	{
+		// deprecated: use the "tailscale" network with the tailscale cert manager instead.
+		name:           "tailscale+tls",
+		defaultNetwork: "tcp",
+		listen:         listenTCP,
+		wrap:           wrapTLS,
+	},
+	{
+		name:           "tailscale+funnel",
+		defaultNetwork: "tcp",
+		listen:         listenFunnel,
+	},
+	{
+		name:           "tailscale-svc",
+		defaultNetwork: "tcp",
+		nodeName:       getServiceNode,
+		listen:         listenService,
+	},
+	{
+		name:           "tailscale/udp",
+		defaultNetwork: "udp",
+		http3Network:   "tailscale/udp",
+		listenPacket:   listenUDP,
+	},
+}
+
+// registerTailscaleNetwork registers n with Caddy.
+func registerTailscaleNetwork(n *tailscaleNetwork) {
+	caddy.RegisterNetwork(n.name, n.getListener)
+	if n.http3Network != "" {
+		caddyhttp.RegisterNetworkHTTP3(n.name, n.http3Network)
+	}
+}
+
+// getListener is the [caddy.ListenerFunc] for n.
+// It returns a listener for the port at portOffset within portRange on the node for host,
+// sharing the underlying listener with any other listener for the same address.
+func (n *tailscaleNetwork) getListener(c context.Context, network string, host string, portRange string, portOffset uint, _ net.ListenConfig) (any, error) {
+	ctx, ok := c.(caddy.Context)
+	if !ok {
+		return nil, fmt.Errorf("context is not a caddy.Context: %T", c)
+	}
+
+	host, network, port, err := parseTailscaleAddr(network, host, portRange, portOffset)
+	if err != nil {
+		return nil, err
+	}
+	if network == "" {
+		network = n.defaultNetwork
+	}
+
+	name := host
+	if n.nodeName != nil {
+		appIface, err := ctx.App("tailscale")
+		if err != nil {
+			return nil, err
+		}
+		if name, err = n.nodeName(host, appIface.(*App)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Get node reference for this listener (increments node reference count)
+	node, err := getRunningNode(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Follow Caddy's standard listener pooling mechanism
+	lnKey := n.listenerKey(host, network, port)
+
+	shared, _, err := tailscaleListeners.LoadOrNew(lnKey, func() (caddy.Destructor, error) {
+		return n.bind(node, host, network, port, lnKey)
+	})
+	if err != nil {
+		_, _ = nodes.Delete(name)
+		return nil, err
+	}
+
+	fakeNode := &fakeCloseNode{nodeName: name, node: node}
+	switch shared := shared.(type) {
+	case *tailscaleSharedPacketConn:
+		return &tailscaleFakeClosePacketConn{tailscaleSharedPacketConn: shared, node: fakeNode}, nil
+	default:
+		return &tailscaleFakeCloseListener{tailscaleSharedListener: shared.(*tailscaleSharedListener), node: fakeNode}, nil
+	}
+}
+
+// listenerKey returns the key of the listener for the port of host in the listener pool.
+func (n *tailscaleNetwork) listenerKey(host, network, port string) string {
+	return fmt.Sprintf("%s/%s:%s:%s", n.name, host, network, port)
+}
+
+// bind creates the shared listener or packet conn for the port of host on the node.
+func (n *tailscaleNetwork) bind(node *tailscaleNode, host, network, port, lnKey string) (caddy.Destructor, error) {
+	stats := new(listenerStats)
+
+	if n.listenPacket != nil {
+		pc, err := n.listenPacket(node, host, network, port)
+		if err != nil {
+			return nil, err
+		}
+		return &tailscaleSharedPacketConn{
+			PacketConn: &countingPacketConn{PacketConn: pc, stats: stats},
+			key:        lnKey,
+			node:       node.name,
+			stats:      stats,
+		}, nil
+	}
+
+	ln, err := n.listen(node, host, network, port)
+	if err != nil {
+		return nil, err
+	}
+	// count the bytes of the underlying connections,
+	// so that wrapped connections, such as TLS connections, keep their type.
+	ln = &countingListener{Listener: ln, stats: stats}
+	if n.wrap != nil {
+		wrapped, err := n.wrap(node, ln)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = wrapped
+	}
+	return &tailscaleSharedListener{
+		Listener: ln,
+		key:      lnKey,
+		node:     node.name,
+		stats:    stats,
+	}, nil
+}
+
+// parseTailscaleAddr returns the node name, network, and port of the listener address
+// at portOffset within portRange.
+// The network is only set if the address specifies one, such as "udp" in "tailscale/udp/myhost:443".
+func parseTailscaleAddr(network, host, portRange string, portOffset uint) (string, string, string, error) {
+	na, err := caddy.ParseNetworkAddress(caddy.JoinNetworkAddress(network, host, portRange))
+	if err != nil {
+		return "", "", "", err
+	}
+	if size := na.PortRangeSize(); portOffset >= size {
+		return "", "", "", fmt.Errorf("port offset %d is out of range for %d ports in %s", portOffset, size, portRange)
+	}
+
+	// The network address is split again without the Tailscale network,
+	// so that any network in the host, such as "udp/myhost", is separated from the node name.
+	network, host, port, err := caddy.SplitNetworkAddress(na.JoinHostPort(portOffset))
+	if err != nil {
+		return "", "", "", err
+	}
+	return host, network, port, nil
+}
+
+// listenTCP listens on the port of the node.
+func listenTCP(node *tailscaleNode, _, network, port string) (net.Listener, error) {
+	return node.Listen(network, ":"+port)
+}
+
+// wrapTLS serves TLS on ln using the node's certificates.
+func wrapTLS(node *tailscaleNode, ln net.Listener) (net.Listener, error) {
+	localClient, err := node.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, &tls.Config{
+		GetCertificate: localClient.GetCertificate,
+	}), nil
+}
+
+// listenUDP listens for packets on the port of the node's Tailscale IPs.
+func listenUDP(node *tailscaleNode, name, network, port string) (net.PacketConn, error) {
+	// The packet conn listens on both the IPv4 and IPv6 address of the node,
+	// unless "udp4" or "udp6" is requested, and is rebound whenever they change.
+	// If the node is not yet running, it is bound once the node's Tailscale IPs are known.
+	if err := node.waitListenable(); err != nil {
+		return nil, err
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := newNodePacketConn(network, uint16(p), node.TailscaleIPs, node.ListenPacket)
+	if err != nil {
+		return nil, err
+	}
+	go pc.watch(node, name, node.logger)
+	return pc, nil
+}
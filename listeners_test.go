@@ -0,0 +1,194 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"tailscale.com/util/must"
+)
+
+func Test_ParseTailscaleAddr(t *testing.T) {
+	tests := map[string]struct {
+		addr        string
+		portOffset  uint
+		wantHost    string
+		wantNetwork string
+		wantPort    string
+		wantErr     bool
+	}{
+		"single port": {
+			addr:     "tailscale/node:80",
+			wantHost: "node",
+			wantPort: "80",
+		},
+		"start of range": {
+			addr:     "tailscale/node:8000-8010",
+			wantHost: "node",
+			wantPort: "8000",
+		},
+		"middle of range": {
+			addr:       "tailscale/node:8000-8010",
+			portOffset: 5,
+			wantHost:   "node",
+			wantPort:   "8005",
+		},
+		"end of range": {
+			addr:       "tailscale/node:8000-8010",
+			portOffset: 10,
+			wantHost:   "node",
+			wantPort:   "8010",
+		},
+		"past end of range": {
+			addr:       "tailscale/node:8000-8010",
+			portOffset: 11,
+			wantErr:    true,
+		},
+		"offset on single port": {
+			addr:       "tailscale/node:80",
+			portOffset: 1,
+			wantErr:    true,
+		},
+		"default node": {
+			addr:     "tailscale/:80",
+			wantPort: "80",
+		},
+		"udp network": {
+			addr:        "tailscale/udp/node:443",
+			wantHost:    "node",
+			wantNetwork: "udp",
+			wantPort:    "443",
+		},
+		"udp range": {
+			addr:        "tailscale/udp/node:8000-8010",
+			portOffset:  3,
+			wantHost:    "node",
+			wantNetwork: "udp",
+			wantPort:    "8003",
+		},
+		"tls network": {
+			addr:     "tailscale+tls/node:443",
+			wantHost: "node",
+			wantPort: "443",
+		},
+		"invalid range": {
+			addr:    "tailscale/node:8010-8000",
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			na, err := caddy.ParseNetworkAddress(tt.addr)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("ParseNetworkAddress(%q) error = %v", tt.addr, err)
+				}
+				return
+			}
+			port := fmt.Sprintf("%d", na.StartPort)
+			if na.EndPort != na.StartPort {
+				port = fmt.Sprintf("%d-%d", na.StartPort, na.EndPort)
+			}
+
+			host, network, gotPort, err := parseTailscaleAddr(na.Network, na.Host, port, tt.portOffset)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTailscaleAddr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if host != tt.wantHost || network != tt.wantNetwork || gotPort != tt.wantPort {
+				t.Errorf("parseTailscaleAddr() = %q, %q, %q, want %q, %q, %q",
+					host, network, gotPort, tt.wantHost, tt.wantNetwork, tt.wantPort)
+			}
+		})
+	}
+}
+
+func Test_ListenPortRange(t *testing.T) {
+	must.Do(caddy.Run(new(caddy.Config)))
+	ctx := caddy.ActiveContext()
+
+	// a network that listens locally, so that listeners can be created without starting the node.
+	// Its listener func is called directly, since networks can only be registered once.
+	var binds int
+	n := &tailscaleNetwork{
+		name:           "tailscale+test",
+		defaultNetwork: "tcp",
+		listen: func(_ *tailscaleNode, _, network, _ string) (net.Listener, error) {
+			binds++
+			return net.Listen(network, "127.0.0.1:0")
+		},
+	}
+	listen := func(offset uint) (any, error) {
+		return n.getListener(ctx, n.name, "rangenode", "8000-8010", offset, net.ListenConfig{})
+	}
+
+	var lns []io.Closer
+	for offset := range uint(11) {
+		ln := must.Get(listen(offset))
+		lns = append(lns, ln.(io.Closer))
+
+		key := fmt.Sprintf("tailscale+test/rangenode:tcp:%d", 8000+offset)
+		if refs, ok := tailscaleListeners.References(key); !ok || refs != 1 {
+			t.Errorf("listener %s references = %d, %v, want 1", key, refs, ok)
+		}
+		if _, ok := ln.(interface{ Unwrap() net.Listener }); !ok {
+			t.Errorf("listener %T does not support Unwrap", ln)
+		}
+	}
+
+	// each port holds a reference to the node
+	if refs, ok := nodes.References("rangenode"); !ok || refs != 11 {
+		t.Errorf("node references = %d, %v, want 11", refs, ok)
+	}
+
+	// listening on the same address again shares the underlying listener
+	ln := must.Get(listen(0))
+	lns = append(lns, ln.(io.Closer))
+	if binds != 11 {
+		t.Errorf("binds = %d, want 11", binds)
+	}
+	if refs, _ := tailscaleListeners.References("tailscale+test/rangenode:tcp:8000"); refs != 2 {
+		t.Errorf("shared listener references = %d, want 2", refs)
+	}
+
+	if _, err := listen(11); err == nil {
+		t.Error("Listen() past the end of the port range succeeded, want error")
+	}
+
+	for _, ln := range lns {
+		must.Do(ln.Close())
+	}
+	if refs, ok := nodes.References("rangenode"); ok && refs != 0 {
+		t.Errorf("node references after close = %d, want 0", refs)
+	}
+	if refs, ok := tailscaleListeners.References("tailscale+test/rangenode:tcp:8005"); ok && refs != 0 {
+		t.Errorf("listener references after close = %d, want 0", refs)
+	}
+}
+
+func Test_ListenUDPBeforeRunning(t *testing.T) {
+	node := newTestNode(t, "udphost")
+	node.runningTimeout = 0
+
+	// the listener is created without waiting for the node to log in
+	pc := must.Get(listenUDP(node, "udphost", "udp4", "5353"))
+	defer pc.Close()
+
+	ip4, _ := node.TailscaleIPs()
+	deadline := time.Now().Add(30 * time.Second)
+	for !ip4.IsValid() || pc.LocalAddr().String() != net.JoinHostPort(ip4.String(), "5353") {
+		if time.Now().After(deadline) {
+			t.Fatalf("LocalAddr() = %v, want the node's Tailscale IPv4 address", pc.LocalAddr())
+		}
+		time.Sleep(10 * time.Millisecond)
+		ip4, _ = node.TailscaleIPs()
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// login.go contains support for interactively logging in Tailscale nodes.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+)
+
+// watchLogin logs the state of the node while it is logging in,
+// including the URL to visit when the node needs to be authenticated interactively.
+// It is started when the node starts, and returns once the node is running or closed.
+func (t *tailscaleNode) watchLogin() {
+	lc, err := t.Server.LocalClient()
+	if err != nil {
+		return
+	}
+	watcher, err := lc.WatchIPNBus(context.Background(), ipn.NotifyInitialState|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return
+	}
+	defer watcher.Close()
+
+	var lastState ipn.State
+	var lastURL string
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			// node has been closed
+			return
+		}
+
+		if n.BrowseToURL != nil && *n.BrowseToURL != "" && *n.BrowseToURL != lastURL {
+			lastURL = *n.BrowseToURL
+			t.logger.Warn("tailscale node needs login, visit the auth URL to authenticate",
+				zap.String("node", t.name),
+				zap.String("auth_url", lastURL))
+		}
+		if n.State == nil || *n.State == lastState {
+			continue
+		}
+
+		switch *n.State {
+		case ipn.NeedsMachineAuth:
+			t.logger.Warn("tailscale node needs to be approved by a tailnet admin", zap.String("node", t.name))
+		case ipn.Running:
+			if lastState != ipn.NoState {
+				t.logger.Info("tailscale node is running", zap.String("node", t.name))
+			}
+			return
+		}
+		lastState = *n.State
+	}
+}
+
+// waitRunning starts the node and waits until it is running.
+// If the node is not running within timeout, an error including the auth URL of the node, if any, is returned.
+func (t *tailscaleNode) waitRunning(ctx context.Context, name string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := t.up(ctx, name)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	lc, err := t.LocalClient()
+	if err != nil {
+		return err
+	}
+	// use a fresh context, since ctx has expired
+	st, err := lc.StatusWithoutPeers(context.Background())
+	if err == nil && st.AuthURL != "" {
+		return fmt.Errorf("tailscale node %s is not running after %v, visit %s to authenticate", name, timeout, st.AuthURL)
+	}
+	if err == nil {
+		return fmt.Errorf("tailscale node %s is not running after %v, state is %s", name, timeout, st.BackendState)
+	}
+	return fmt.Errorf("tailscale node %s is not running after %v", name, timeout)
+}
+
+// waitListenable starts the node, and if it is configured to wait for running,
+// waits until it is running for at most the node's running timeout.
+// Otherwise, listeners that need the node to be running are set up once it is.
+func (t *tailscaleNode) waitListenable() error {
+	if t.runningTimeout == 0 {
+		_, err := t.LocalClient()
+		return err
+	}
+	return t.waitRunning(context.Background(), t.name, t.runningTimeout)
+}
+
+// up starts the node and waits until it is running or ctx is done.
+//
+// Unlike [tsnet.Server.Up], the node's serve config is not reset,
+// so it is safe to wait for a node that is already serving Funnel listeners.
+func (t *tailscaleNode) up(ctx context.Context, name string) error {
+	lc, err := t.LocalClient()
+	if err != nil {
+		return err
+	}
+
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialState|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return err
+		}
+		if n.ErrMessage != nil {
+			return fmt.Errorf("tailscale node %s: %s", name, *n.ErrMessage)
+		}
+		if n.State != nil && *n.State == ipn.Running {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// matcher.go contains the MatchTailscale request matcher.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types/ref"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func init() {
+	caddy.RegisterModule(MatchTailscale{})
+}
+
+// MatchTailscale matches requests by the Tailscale identity of the connecting peer.
+// Identity is looked up the same way as the tailscale_auth provider does:
+// using the tailscale node the request was received on, or the local tailscaled daemon.
+//
+// Each field matches if any of its values match. All configured fields must match.
+// Requests from peers that are not part of the tailnet never match.
+//
+// For example, in a Caddyfile:
+//
+//	@admins tailscale user alice@example.com bob@example.com
+//
+//	@ci tailscale {
+//	  tag tag:ci
+//	  tailnet example.com
+//	}
+type MatchTailscale struct {
+	// Users matches the full login name of the user, such as "alice@example.com".
+	Users []string `json:"user,omitempty"`
+
+	// Domains matches the domain portion of the user's login name, such as "example.com".
+	Domains []string `json:"domain,omitempty"`
+
+	// Nodes matches the name of the connecting node,
+	// either as its short MagicDNS name or its fully qualified domain name.
+	Nodes []string `json:"node,omitempty"`
+
+	// Tags matches any of the ACL tags of the connecting node, such as "tag:server".
+	Tags []string `json:"tag,omitempty"`
+
+	// Tailnets matches the name of the tailnet the connecting node belongs to.
+	Tailnets []string `json:"tailnet,omitempty"`
+
+	// Capabilities matches any peer capability granted to the connecting node,
+	// such as "example.com/cap/admin".
+	Capabilities []string `json:"capability,omitempty"`
+}
+
+func (MatchTailscale) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.tailscale",
+		New: func() caddy.Module { return new(MatchTailscale) },
+	}
+}
+
+// Provision registers hooks to resolve the tailscale node for each connection when it is accepted,
+// and whether the connection arrived over Funnel.
+func (m *MatchTailscale) Provision(ctx caddy.Context) error {
+	registerLocalClientConnContext(ctx)
+	registerFunnelConnContext(ctx)
+	return nil
+}
+
+// UnmarshalCaddyfile populates a MatchTailscale from a caddyfile.
+// Fields can be specified inline or as a block:
+//
+//	tailscale <field> <values...>
+//
+//	tailscale {
+//	  <field> <values...>
+//	}
+//
+// Multiple occurrences of the same field are merged.
+func (m *MatchTailscale) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// iterate to merge multiple matchers into one
+	for d.Next() {
+		if d.NextArg() {
+			field := d.Val()
+			if err := m.addValues(field, d.RemainingArgs()); err != nil {
+				return d.WrapErr(err)
+			}
+		}
+		for d.NextBlock(0) {
+			field := d.Val()
+			if err := m.addValues(field, d.RemainingArgs()); err != nil {
+				return d.WrapErr(err)
+			}
+		}
+	}
+	return nil
+}
+
+// addValues appends values to the matcher field with the given name.
+func (m *MatchTailscale) addValues(field string, values []string) error {
+	if len(values) == 0 {
+		return fmt.Errorf("malformed tailscale matcher: %s requires at least one value", field)
+	}
+	switch field {
+	case "user":
+		m.Users = append(m.Users, values...)
+	case "domain":
+		m.Domains = append(m.Domains, values...)
+	case "node":
+		m.Nodes = append(m.Nodes, values...)
+	case "tag":
+		m.Tags = append(m.Tags, values...)
+	case "tailnet":
+		m.Tailnets = append(m.Tailnets, values...)
+	case "capability":
+		m.Capabilities = append(m.Capabilities, values...)
+	default:
+		return fmt.Errorf("unrecognized tailscale matcher field: %s", field)
+	}
+	return nil
+}
+
+// CELLibrary produces options that make MatchTailscale available in CEL expressions.
+//
+// Example:
+//
+//	expression tailscale({'user': ['alice@example.com'], 'tag': ['tag:ci']})
+func (MatchTailscale) CELLibrary(_ caddy.Context) (cel.Library, error) {
+	return caddyhttp.CELMatcherImpl(
+		"tailscale",
+		"tailscale_matcher_request_map",
+		[]*cel.Type{caddyhttp.CELTypeJSON},
+		func(data ref.Val) (caddyhttp.RequestMatcherWithError, error) {
+			fields, err := caddyhttp.CELValueToMapStrList(data)
+			if err != nil {
+				return nil, err
+			}
+			m := new(MatchTailscale)
+			for field, values := range fields {
+				if err := m.addValues(field, values); err != nil {
+					return nil, err
+				}
+			}
+			return m, nil
+		},
+	)
+}
+
+// Match returns true if the request matches all configured fields.
+func (m MatchTailscale) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+// MatchWithError returns true if the request matches all configured fields.
+// Requests that arrived over Funnel have no Tailscale identity, so never match.
+func (m MatchTailscale) MatchWithError(r *http.Request) (bool, error) {
+	if isFunnelRequest(r) {
+		return false, nil
+	}
+
+	client, err := localClientForRequest(r)
+	if err != nil {
+		return false, err
+	}
+
+	info, err := client.WhoIs(r.Context(), r.RemoteAddr)
+	if errors.Is(err, local.ErrPeerNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return m.matchWhoIs(info), nil
+}
+
+// matchWhoIs reports whether the WhoIs response info matches all configured fields.
+func (m MatchTailscale) matchWhoIs(info *apitype.WhoIsResponse) bool {
+	if len(m.Users) > 0 && !slices.Contains(m.Users, info.UserProfile.LoginName) {
+		return false
+	}
+
+	if len(m.Domains) > 0 {
+		_, domain, _ := strings.Cut(info.UserProfile.LoginName, "@")
+		if !slices.ContainsFunc(m.Domains, func(d string) bool { return strings.EqualFold(d, domain) }) {
+			return false
+		}
+	}
+
+	if len(m.Nodes) > 0 {
+		fqdn := strings.TrimSuffix(info.Node.Name, ".")
+		if !slices.ContainsFunc(m.Nodes, func(n string) bool {
+			return strings.EqualFold(n, info.Node.ComputedName) || strings.EqualFold(strings.TrimSuffix(n, "."), fqdn)
+		}) {
+			return false
+		}
+	}
+
+	if len(m.Tags) > 0 && !slices.ContainsFunc(m.Tags, func(t string) bool { return slices.Contains(info.Node.Tags, t) }) {
+		return false
+	}
+
+	if len(m.Tailnets) > 0 && !slices.Contains(m.Tailnets, tailnetName(info)) {
+		return false
+	}
+
+	if len(m.Capabilities) > 0 && !slices.ContainsFunc(m.Capabilities, func(c string) bool {
+		return info.CapMap.HasCapability(tailcfg.PeerCapability(c))
+	}) {
+		return false
+	}
+
+	return true
+}
+
+var (
+	_ caddyhttp.RequestMatcher          = (*MatchTailscale)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchTailscale)(nil)
+	_ caddyhttp.CELLibraryProducer      = (*MatchTailscale)(nil)
+	_ caddy.Provisioner                 = (*MatchTailscale)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchTailscale)(nil)
+)
@@ -0,0 +1,162 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func Test_ParseMatcher(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    MatchTailscale
+		wantErr bool
+	}{
+		"inline users": {
+			input: `tailscale user alice@example.com bob@example.com`,
+			want:  MatchTailscale{Users: []string{"alice@example.com", "bob@example.com"}},
+		},
+		"block": {
+			input: `tailscale {
+				tag tag:ci tag:bot
+				tailnet example.com
+				capability example.com/cap/admin
+			}`,
+			want: MatchTailscale{
+				Tags:         []string{"tag:ci", "tag:bot"},
+				Tailnets:     []string{"example.com"},
+				Capabilities: []string{"example.com/cap/admin"},
+			},
+		},
+		"merged": {
+			input: `tailscale node web
+				tailscale node db`,
+			want: MatchTailscale{Nodes: []string{"web", "db"}},
+		},
+		"missing value": {
+			input:   `tailscale user`,
+			wantErr: true,
+		},
+		"unknown field": {
+			input:   `tailscale foo bar`,
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got MatchTailscale
+			err := got.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("UnmarshalCaddyfile() diff(-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_MatchWhoIs(t *testing.T) {
+	user := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:         "laptop.example.ts.net.",
+			ComputedName: "laptop",
+			Hostinfo:     (&tailcfg.Hostinfo{}).View(),
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		CapMap: tailcfg.PeerCapMap{
+			"example.com/cap/admin": nil,
+		},
+	}
+	tagged := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:         "runner.example.ts.net.",
+			ComputedName: "runner",
+			Hostinfo:     (&tailcfg.Hostinfo{}).View(),
+			Tags:         []string{"tag:ci"},
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+	}
+
+	tests := map[string]struct {
+		m    MatchTailscale
+		info *apitype.WhoIsResponse
+		want bool
+	}{
+		"empty matcher": {
+			info: user,
+			want: true,
+		},
+		"user": {
+			m:    MatchTailscale{Users: []string{"bob@example.com", "alice@example.com"}},
+			info: user,
+			want: true,
+		},
+		"wrong user": {
+			m:    MatchTailscale{Users: []string{"bob@example.com"}},
+			info: user,
+			want: false,
+		},
+		"domain": {
+			m:    MatchTailscale{Domains: []string{"EXAMPLE.com"}},
+			info: user,
+			want: true,
+		},
+		"node short name": {
+			m:    MatchTailscale{Nodes: []string{"laptop"}},
+			info: user,
+			want: true,
+		},
+		"node fqdn": {
+			m:    MatchTailscale{Nodes: []string{"laptop.example.ts.net"}},
+			info: user,
+			want: true,
+		},
+		"tailnet": {
+			m:    MatchTailscale{Tailnets: []string{"example.ts.net"}},
+			info: user,
+			want: true,
+		},
+		"capability": {
+			m:    MatchTailscale{Capabilities: []string{"example.com/cap/admin"}},
+			info: user,
+			want: true,
+		},
+		"missing capability": {
+			m:    MatchTailscale{Capabilities: []string{"example.com/cap/admin"}},
+			info: tagged,
+			want: false,
+		},
+		"tag": {
+			m:    MatchTailscale{Tags: []string{"tag:ci"}},
+			info: tagged,
+			want: true,
+		},
+		"untagged node": {
+			m:    MatchTailscale{Tags: []string{"tag:ci"}},
+			info: user,
+			want: false,
+		},
+		"all fields must match": {
+			m:    MatchTailscale{Users: []string{"alice@example.com"}, Tags: []string{"tag:ci"}},
+			info: user,
+			want: false,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tt.m.matchWhoIs(tt.info); got != tt.want {
+				t.Errorf("matchWhoIs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
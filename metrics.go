@@ -0,0 +1,229 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// metrics.go contains the Prometheus metrics for Tailscale nodes, listeners, and identity lookups.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace, metricsSubsystem = "caddy", "tailscale"
+
+// metricsStatusTimeout is the maximum time to wait for the status of a node when collecting metrics.
+const metricsStatusTimeout = 5 * time.Second
+
+var (
+	nodeStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "node_state"),
+		"Backend state of the Tailscale node. The value is 1 for the current state.",
+		[]string{"node", "state"}, nil)
+	nodePeersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "node_peers"),
+		"Number of peers of the Tailscale node.",
+		[]string{"node"}, nil)
+	nodeDERPRegionDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "node_derp_region"),
+		"Home DERP region of the Tailscale node. The value is 1 for the region in use.",
+		[]string{"node", "region"}, nil)
+	nodeConnectionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "node_peer_connections"),
+		"Number of active peer connections of the Tailscale node, by whether they are direct or relayed.",
+		[]string{"node", "type"}, nil)
+
+	listenerAcceptedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "listener_accepted_connections_total"),
+		"Number of connections accepted by the Tailscale listener.",
+		[]string{"node", "listener"}, nil)
+	listenerReceivedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "listener_received_bytes_total"),
+		"Number of bytes received on the Tailscale listener.",
+		[]string{"node", "listener"}, nil)
+	listenerSentDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "listener_sent_bytes_total"),
+		"Number of bytes sent on the Tailscale listener.",
+		[]string{"node", "listener"}, nil)
+)
+
+var (
+	whoIsDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "whois_duration_seconds",
+		Help:      "Histogram of the duration of WhoIs lookups made by the tailscale_auth provider.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	whoIsErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "whois_errors_total",
+		Help:      "Number of failed WhoIs lookups made by the tailscale_auth provider.",
+	})
+	whoIsCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "whois_cache_lookups_total",
+		Help:      "Number of lookups in the tailscale_auth identity cache, by whether they were a hit or a miss.",
+	}, []string{"result"})
+)
+
+// registerMetrics registers the Tailscale metrics with registry, which is usually Caddy's metrics registry.
+// Metrics that are already registered are skipped, since multiple modules may register them.
+func registerMetrics(registry *prometheus.Registry) error {
+	if registry == nil {
+		return nil
+	}
+	for _, c := range []prometheus.Collector{nodeCollector{}, whoIsDuration, whoIsErrors, whoIsCacheLookups} {
+		if err := registry.Register(c); err != nil {
+			if are := (prometheus.AlreadyRegisteredError{}); !errors.As(err, &are) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nodeCollector collects metrics for the nodes and listeners in use when scraped.
+type nodeCollector struct{}
+
+func (nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nodeStateDesc
+	ch <- nodePeersDesc
+	ch <- nodeDERPRegionDesc
+	ch <- nodeConnectionsDesc
+	ch <- listenerAcceptedDesc
+	ch <- listenerReceivedDesc
+	ch <- listenerSentDesc
+}
+
+func (nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, node := range poolNodes() {
+		if !node.started() {
+			continue
+		}
+		lc, err := node.LocalClient()
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), metricsStatusTimeout)
+		st, err := lc.Status(ctx)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(nodeStateDesc, prometheus.GaugeValue, 1, name, st.BackendState)
+		ch <- prometheus.MustNewConstMetric(nodePeersDesc, prometheus.GaugeValue, float64(len(st.Peer)), name)
+		if st.Self != nil && st.Self.Relay != "" {
+			ch <- prometheus.MustNewConstMetric(nodeDERPRegionDesc, prometheus.GaugeValue, 1, name, st.Self.Relay)
+		}
+
+		var direct, relayed int
+		for _, peer := range st.Peer {
+			if !peer.Active {
+				continue
+			}
+			if peer.CurAddr != "" {
+				direct++
+			} else {
+				relayed++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(nodeConnectionsDesc, prometheus.GaugeValue, float64(direct), name, "direct")
+		ch <- prometheus.MustNewConstMetric(nodeConnectionsDesc, prometheus.GaugeValue, float64(relayed), name, "relayed")
+	}
+
+	tailscaleListeners.Range(func(key, value any) bool {
+		var node string
+		var stats *listenerStats
+		switch ln := value.(type) {
+		case *tailscaleSharedListener:
+			node, stats = ln.node, ln.stats
+		case *tailscaleSharedPacketConn:
+			node, stats = ln.node, ln.stats
+		}
+		if stats == nil {
+			return true
+		}
+		lnKey := key.(string)
+		ch <- prometheus.MustNewConstMetric(listenerAcceptedDesc, prometheus.CounterValue, float64(stats.accepted.Load()), node, lnKey)
+		ch <- prometheus.MustNewConstMetric(listenerReceivedDesc, prometheus.CounterValue, float64(stats.received.Load()), node, lnKey)
+		ch <- prometheus.MustNewConstMetric(listenerSentDesc, prometheus.CounterValue, float64(stats.sent.Load()), node, lnKey)
+		return true
+	})
+}
+
+// listenerStats counts the traffic on a Tailscale listener or packet conn.
+type listenerStats struct {
+	accepted atomic.Uint64
+	received atomic.Uint64
+	sent     atomic.Uint64
+}
+
+// countingListener is a [net.Listener] that counts accepted connections
+// and the bytes read from and written to them.
+type countingListener struct {
+	net.Listener
+	stats *listenerStats
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.stats.accepted.Add(1)
+	return &countingConn{Conn: c, stats: l.stats}, nil
+}
+
+// countingConn is a [net.Conn] that counts the bytes read from and written to it.
+type countingConn struct {
+	net.Conn
+	stats *listenerStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.received.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.sent.Add(uint64(n))
+	return n, err
+}
+
+// NetConn returns the underlying connection.
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// countingPacketConn is a [net.PacketConn] that counts the bytes read from and written to it.
+type countingPacketConn struct {
+	net.PacketConn
+	stats *listenerStats
+}
+
+func (c *countingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	c.stats.received.Add(uint64(n))
+	return n, addr, err
+}
+
+func (c *countingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	c.stats.sent.Add(uint64(n))
+	return n, err
+}
+
+var (
+	_ prometheus.Collector = nodeCollector{}
+)
@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tailscale.com/util/must"
+)
+
+func Test_RegisterMetrics(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	must.Do(registerMetrics(registry))
+	// registering again, such as from another module, is a no-op
+	must.Do(registerMetrics(registry))
+	must.Do(registerMetrics(nil))
+
+	if _, err := registry.Gather(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ListenerMetrics(t *testing.T) {
+	const lnKey = "tailscale/metricsnode:tcp:80"
+
+	stats := new(listenerStats)
+	ln := &countingListener{Listener: must.Get(net.Listen("tcp", "127.0.0.1:0")), stats: stats}
+	tailscaleListeners.LoadOrStore(lnKey, &tailscaleSharedListener{Listener: ln, key: lnKey, node: "metricsnode", stats: stats})
+	defer tailscaleListeners.Delete(lnKey)
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("ping"))
+		io.ReadFull(c, make([]byte, 8))
+	}()
+
+	c := must.Get(ln.Accept())
+	must.Get(io.ReadFull(c, make([]byte, 4)))
+	must.Get(c.Write([]byte("pongpong")))
+	c.Close()
+
+	expected := `
+# HELP caddy_tailscale_listener_accepted_connections_total Number of connections accepted by the Tailscale listener.
+# TYPE caddy_tailscale_listener_accepted_connections_total counter
+caddy_tailscale_listener_accepted_connections_total{listener="tailscale/metricsnode:tcp:80",node="metricsnode"} 1
+# HELP caddy_tailscale_listener_received_bytes_total Number of bytes received on the Tailscale listener.
+# TYPE caddy_tailscale_listener_received_bytes_total counter
+caddy_tailscale_listener_received_bytes_total{listener="tailscale/metricsnode:tcp:80",node="metricsnode"} 4
+# HELP caddy_tailscale_listener_sent_bytes_total Number of bytes sent on the Tailscale listener.
+# TYPE caddy_tailscale_listener_sent_bytes_total counter
+caddy_tailscale_listener_sent_bytes_total{listener="tailscale/metricsnode:tcp:80",node="metricsnode"} 8
+`
+	if err := testutil.CollectAndCompare(nodeCollector{}, strings.NewReader(expected),
+		"caddy_tailscale_listener_accepted_connections_total",
+		"caddy_tailscale_listener_received_bytes_total",
+		"caddy_tailscale_listener_sent_bytes_total",
+	); err != nil {
+		t.Error(err)
+	}
+}
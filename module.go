@@ -4,7 +4,7 @@
 // Package tscaddy provides a set of Caddy modules to integrate Tailscale into Caddy.
 package tscaddy
 
-// module.go contains the Tailscale network listeners for caddy
+// module.go contains the shared Tailscale listener types for caddy
 // as well as some shared logic for registered Tailscale nodes.
 
 import (
@@ -13,30 +13,30 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"net/netip"
 	"os"
 	"path/filepath"
-	"strconv"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
-	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/certmagic"
 	"github.com/tailscale/tscert"
 	"go.uber.org/zap"
 	"tailscale.com/client/local"
 	"tailscale.com/hostinfo"
+	"tailscale.com/ipn"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 )
 
 func init() {
-	caddy.RegisterNetwork("tailscale", getTCPListener)
-	caddy.RegisterNetwork("tailscale+tls", getTLSListener)
-	caddy.RegisterNetwork("tailscale/udp", getUDPListener)
-	caddyhttp.RegisterNetworkHTTP3("tailscale/udp", "tailscale/udp")
-	caddyhttp.RegisterNetworkHTTP3("tailscale", "tailscale/udp")
+	for _, n := range tailscaleNetworks {
+		registerTailscaleNetwork(n)
+	}
 
 	// Caddy uses tscert to get certificates for Tailscale hostnames.
 	// Update the tscert transport to send requests to the correct tsnet server,
@@ -45,202 +45,6 @@ func init() {
 	hostinfo.SetApp("caddy")
 }
 
-func getTCPListener(c context.Context, network string, host string, portRange string, portOffset uint, _ net.ListenConfig) (any, error) {
-	ctx, ok := c.(caddy.Context)
-	if !ok {
-		return nil, fmt.Errorf("context is not a caddy.Context: %T", c)
-	}
-
-	na, err := caddy.ParseNetworkAddress(caddy.JoinNetworkAddress(network, host, portRange))
-	if err != nil {
-		return nil, err
-	}
-
-	addr := na.JoinHostPort(portOffset)
-	network, host, port, err := caddy.SplitNetworkAddress(addr)
-	if err != nil {
-		return nil, err
-	}
-
-	if network == "" {
-		network = "tcp"
-	}
-
-	// Get node reference for this listener (increments node reference count)
-	node, err := getNode(ctx, host)
-	if err != nil {
-		return nil, err
-	}
-
-	// Follow Caddy's standard listener pooling mechanism
-	lnKey := fmt.Sprintf("tailscale/%s:%s:%s", host, network, port)
-
-	sharedLn, _, err := tailscaleListeners.LoadOrNew(lnKey, func() (caddy.Destructor, error) {
-		ln, err := node.Listen(network, ":"+port)
-		if err != nil {
-			return nil, err
-		}
-
-		return &tailscaleSharedListener{
-			Listener: ln,
-			key:      lnKey,
-		}, nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return &tailscaleFakeCloseListener{
-		tailscaleSharedListener: sharedLn.(*tailscaleSharedListener),
-		node:                    &fakeCloseNode{nodeName: host, node: node},
-	}, nil
-}
-
-func getTLSListener(c context.Context, network string, host string, portRange string, portOffset uint, _ net.ListenConfig) (any, error) {
-	ctx, ok := c.(caddy.Context)
-	if !ok {
-		return nil, fmt.Errorf("context is not a caddy.Context: %T", c)
-	}
-
-	na, err := caddy.ParseNetworkAddress(caddy.JoinNetworkAddress(network, host, portRange))
-	if err != nil {
-		return nil, err
-	}
-
-	addr := na.JoinHostPort(portOffset)
-	network, host, port, err := caddy.SplitNetworkAddress(addr)
-	if err != nil {
-		return nil, err
-	}
-
-	if network == "" {
-		network = "tcp"
-	}
-
-	// Get node reference for this listener (increments node reference count)
-	node, err := getNode(ctx, host)
-	if err != nil {
-		return nil, err
-	}
-
-	// Follow Caddy's standard listener pooling mechanism
-	lnKey := fmt.Sprintf("tailscale+tls/%s:%s:%s", host, network, port)
-
-	sharedLn, _, err := tailscaleListeners.LoadOrNew(lnKey, func() (caddy.Destructor, error) {
-		ln, err := node.Listen(network, ":"+port)
-		if err != nil {
-			return nil, err
-		}
-
-		localClient, _ := node.LocalClient()
-		tlsLn := tls.NewListener(ln, &tls.Config{
-			GetCertificate: localClient.GetCertificate,
-		})
-
-		return &tailscaleSharedListener{
-			Listener: tlsLn,
-			key:      lnKey,
-		}, nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return &tailscaleFakeCloseListener{
-		tailscaleSharedListener: sharedLn.(*tailscaleSharedListener),
-		node:                    &fakeCloseNode{nodeName: host, node: node},
-	}, nil
-}
-
-func getUDPListener(c context.Context, network string, host string, portRange string, portOffset uint, _ net.ListenConfig) (any, error) {
-	ctx, ok := c.(caddy.Context)
-	if !ok {
-		return nil, fmt.Errorf("context is not a caddy.Context: %T", c)
-	}
-
-	na, err := caddy.ParseNetworkAddress(caddy.JoinNetworkAddress(network, host, portRange))
-	if err != nil {
-		return nil, err
-	}
-
-	addr := na.JoinHostPort(portOffset)
-	network, host, port, err := caddy.SplitNetworkAddress(addr)
-	if err != nil {
-		return nil, err
-	}
-
-	if network == "" {
-		network = "udp"
-	}
-
-	// Get node reference for this listener (increments node reference count)
-	node, err := getNode(ctx, host)
-	if err != nil {
-		return nil, err
-	}
-
-	// Follow Caddy's standard listener pooling mechanism
-	lnKey := fmt.Sprintf("tailscale/udp/%s:%s:%s", host, network, port)
-
-	sharedPc, _, err := tailscaleListeners.LoadOrNew(lnKey, func() (caddy.Destructor, error) {
-		st, err := node.Up(context.Background())
-		if err != nil {
-			return nil, err
-		}
-
-		// We can only return one listener and MagicDNS returns IPv4 addresses unless IPv4 is disabled
-		// Prefer IPv4 if available unless IPv6 was explicitly requested
-		// TODO(will): watch for Tailscale IP changes and update listener
-		var ap netip.AddrPort
-
-		// First pass: look for IPv4 tsnet address if IPv4 was implicitly ("udp") or explicitly ("udp4") requested
-		if network == "udp" || network == "udp4" {
-			for _, ip := range st.TailscaleIPs {
-				if ip.Is4() {
-					p, _ := strconv.Atoi(port)
-					ap = netip.AddrPortFrom(ip, uint16(p))
-					network = "udp4" // Update network for tsnet
-					break
-				}
-			}
-		}
-
-		// Second pass: look for IPv6 tsnet address if IPv6 was implicitly ("udp") or explicitly ("udp6") requested
-		if !ap.IsValid() && (network == "udp" || network == "udp6") {
-			for _, ip := range st.TailscaleIPs {
-				if ip.Is6() {
-					p, _ := strconv.Atoi(port)
-					ap = netip.AddrPortFrom(ip, uint16(p))
-					network = "udp6" // Update network for tsnet
-					break
-				}
-			}
-		}
-
-		if !ap.IsValid() {
-			return nil, fmt.Errorf("no suitable Tailscale IP address found for UDP listener")
-		}
-
-		pc, err := node.ListenPacket(network, ap.String())
-		if err != nil {
-			return nil, err
-		}
-
-		return &tailscaleSharedPacketConn{
-			PacketConn: pc,
-			key:        lnKey,
-		}, nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return &tailscaleFakeClosePacketConn{
-		tailscaleSharedPacketConn: sharedPc.(*tailscaleSharedPacketConn),
-		node:                      &fakeCloseNode{nodeName: host, node: node},
-	}, nil
-}
-
 // nodes are the Tailscale nodes that have been configured and started.
 // Node configuration comes from the global Tailscale Caddy app.
 // When nodes are no longer in used (e.g. all listeners have been closed), they are shutdown.
@@ -252,6 +56,10 @@ var nodes = caddy.NewUsagePool()
 // This ensures listeners are properly closed when removed from configuration.
 var tailscaleListeners = caddy.NewUsagePool()
 
+// ipnBusRetryInterval is the minimum time between attempts to watch the IPN bus of a node
+// for netmap changes, such as for tailscale upstreams and Tailscale Service addresses.
+const ipnBusRetryInterval = 5 * time.Second
+
 // getNode returns a tailscale node for Caddy apps to interface with.
 //
 // The specified name will be used to lookup the node configuration from the tailscale caddy app,
@@ -265,6 +73,19 @@ func getNode(ctx caddy.Context, name string) (*tailscaleNode, error) {
 	app := appIface.(*App)
 
 	s, _, err := nodes.LoadOrNew(name, func() (caddy.Destructor, error) {
+		node := &tailscaleNode{
+			name:           name,
+			logger:         app.logger,
+			funnel:         getFunnel(name, app),
+			startupTimeout: getStartupTimeout(name, app),
+		}
+		if node.runningTimeout = getLoginTimeout(name, app); node.runningTimeout == 0 && getWaitForRunning(name, app) {
+			node.runningTimeout = getStartupTimeout(name, app)
+		}
+		if node.services, err = getAdvertiseServices(name, app); err != nil {
+			return nil, err
+		}
+
 		s := &tsnet.Server{
 			Logf: func(format string, args ...any) {
 				app.logger.Sugar().Debugf(format, args...)
@@ -278,7 +99,7 @@ func getNode(ctx caddy.Context, name string) (*tailscaleNode, error) {
 			AdvertiseTags: getTags(name, app),
 		}
 
-		if s.AuthKey, err = getAuthKey(name, app); err != nil {
+		if s.AuthKey, err = getAuthKey(ctx, name, app); err != nil {
 			return nil, err
 		}
 		if s.ControlURL, err = getControlURL(name, app); err != nil {
@@ -295,29 +116,125 @@ func getNode(ctx caddy.Context, name string) (*tailscaleNode, error) {
 			return nil, err
 		}
 
-		return &tailscaleNode{
-			s,
-		}, nil
+		switch kind := getStateStore(name, app); kind {
+		case stateStoreFile:
+			// tsnet stores state in the state directory by default
+		case stateStoreCaddyStorage:
+			store := newStorageStateStore(ctx.Storage(), name)
+			lockCtx, cancel := context.WithTimeout(ctx, getStartupTimeout(name, app))
+			node.unlock, err = store.lock(lockCtx, app.logger)
+			cancel()
+			if err != nil {
+				return nil, fmt.Errorf("locking state of tailscale node %s, which may be running in another Caddy instance: %w", name, err)
+			}
+			s.Store = store
+		default:
+			return nil, fmt.Errorf("unknown state store %q", kind)
+		}
+
+		node.Server = s
+
+		if prefs := getPrefs(name, app); prefs != nil {
+			// Prefs can only be edited once the node is started,
+			// which otherwise happens when it is first used.
+			lc, err := node.LocalClient()
+			if err == nil {
+				_, err = lc.EditPrefs(ctx, prefs)
+			}
+			if err != nil {
+				node.Destruct()
+				return nil, fmt.Errorf("setting prefs of tailscale node %s: %w", name, err)
+			}
+		}
+		return node, nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	node := s.(*tailscaleNode)
+
+	if timeout := getLoginTimeout(name, app); timeout > 0 {
+		if err := node.waitRunning(ctx, name, timeout); err != nil {
+			_, _ = nodes.Delete(name)
+			return nil, err
+		}
+	}
 
-	return s.(*tailscaleNode), nil
+	return node, nil
+}
+
+// defaultStartupTimeout is how long to wait for a node to be running when wait_for_running is set
+// without a startup timeout.
+const defaultStartupTimeout = time.Minute
+
+// releaseNode releases the reference to the named node that a module got from getNode in Provision.
+// node is the node the module got, which is nil if Provision failed before getting it,
+// in which case there is no reference to release.
+func releaseNode(name string, node *tailscaleNode) error {
+	if node == nil {
+		return nil
+	}
+	// Decrement usage count of this node.
+	_, err := nodes.Delete(name)
+	return err
+}
+
+// getRunningNode returns the named tailscale node, like getNode.
+// If the node is configured to wait for running, it also waits until the node is running,
+// returning an error if it is not running within the startup timeout.
+func getRunningNode(ctx caddy.Context, name string) (*tailscaleNode, error) {
+	node, err := getNode(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	appIface, err := ctx.App("tailscale")
+	if err != nil {
+		_, _ = nodes.Delete(name)
+		return nil, err
+	}
+	app := appIface.(*App)
+
+	if getWaitForRunning(name, app) {
+		if err := node.waitRunning(ctx, name, getStartupTimeout(name, app)); err != nil {
+			_, _ = nodes.Delete(name)
+			return nil, err
+		}
+	}
+
+	return node, nil
 }
 
 var repl = caddy.NewReplacer()
 
-func getAuthKey(name string, app *App) (string, error) {
+// getAuthKey returns the auth key used to register the named node.
+//
+// Auth keys are taken from the first of the following that is configured,
+// with node configuration taking precedence over the app defaults:
+// an auth key, an auth key file, or OAuth client credentials used to mint a new auth key.
+// If none are configured, the TS_AUTHKEY_<HOST> and TS_AUTHKEY env vars are used.
+func getAuthKey(ctx context.Context, name string, app *App) (string, error) {
 	if node, ok := app.Nodes[name]; ok {
 		if node.AuthKey != "" {
 			return repl.ReplaceOrErr(node.AuthKey, true, true)
 		}
+		if node.AuthKeyFile != "" {
+			return readAuthKeyFile(node.AuthKeyFile)
+		}
+		if node.OAuthClientSecret != "" {
+			return mintAuthKey(ctx, name, app, node.OAuthClientID, node.OAuthClientSecret)
+		}
 	}
 
 	if app.DefaultAuthKey != "" {
 		return repl.ReplaceOrErr(app.DefaultAuthKey, true, true)
 	}
+	if app.AuthKeyFile != "" {
+		return readAuthKeyFile(app.AuthKeyFile)
+	}
+	if app.OAuthClientSecret != "" {
+		return mintAuthKey(ctx, name, app, app.OAuthClientID, app.OAuthClientSecret)
+	}
 
 	// Set authkey to "TS_AUTHKEY_<HOST>".
 	// If empty, fall back to "TS_AUTHKEY".
@@ -348,6 +265,13 @@ func getEphemeral(name string, app *App) bool {
 	return app.Ephemeral
 }
 
+func getFunnel(name string, app *App) bool {
+	if node, ok := app.Nodes[name]; ok {
+		return node.Funnel
+	}
+	return false
+}
+
 func getHostname(name string, app *App) (string, error) {
 	if app == nil {
 		return name, nil
@@ -361,6 +285,27 @@ func getHostname(name string, app *App) (string, error) {
 	return name, nil
 }
 
+func getLoginTimeout(name string, app *App) time.Duration {
+	if node, ok := app.Nodes[name]; ok {
+		if node.LoginTimeout != 0 {
+			return time.Duration(node.LoginTimeout)
+		}
+	}
+	return time.Duration(app.LoginTimeout)
+}
+
+func getStartupTimeout(name string, app *App) time.Duration {
+	if node, ok := app.Nodes[name]; ok {
+		if node.StartupTimeout != 0 {
+			return time.Duration(node.StartupTimeout)
+		}
+	}
+	if app.StartupTimeout != 0 {
+		return time.Duration(app.StartupTimeout)
+	}
+	return defaultStartupTimeout
+}
+
 func getPort(name string, app *App) uint16 {
 	if node, ok := app.Nodes[name]; ok {
 		return node.Port
@@ -402,6 +347,69 @@ func getWebUI(name string, app *App) bool {
 	return app.WebUI
 }
 
+func getWaitForRunning(name string, app *App) bool {
+	if node, ok := app.Nodes[name]; ok {
+		if v, ok := node.WaitForRunning.Get(); ok {
+			return v
+		}
+	}
+	return app.WaitForRunning
+}
+
+// getPrefs returns the routing, DNS, and service prefs configured for the named node,
+// or nil if none are configured.
+// Prefs that are not configured are left unchanged, keeping the Tailscale defaults.
+func getPrefs(name string, app *App) *ipn.MaskedPrefs {
+	node := app.Nodes[name]
+	prefs := new(ipn.MaskedPrefs)
+
+	routes := app.AdvertiseRoutes
+	if node.AdvertiseRoutes != nil {
+		routes = node.AdvertiseRoutes
+	}
+	exitNode, exitNodeSet := node.AdvertiseExitNode.Get()
+	if !exitNodeSet && app.AdvertiseExitNode {
+		exitNode, exitNodeSet = true, true
+	}
+	if routes != nil || exitNodeSet {
+		prefs.AdvertiseRoutes = slices.Clone(routes)
+		if exitNode {
+			prefs.AdvertiseRoutes = append(prefs.AdvertiseRoutes, tsaddr.ExitRoutes()...)
+		}
+		prefs.AdvertiseRoutesSet = true
+	}
+
+	acceptRoutes, ok := node.AcceptRoutes.Get()
+	if !ok {
+		acceptRoutes, ok = app.AcceptRoutes.Get()
+	}
+	if ok {
+		prefs.RouteAll = acceptRoutes
+		prefs.RouteAllSet = true
+	}
+
+	acceptDNS, ok := node.AcceptDNS.Get()
+	if !ok {
+		acceptDNS, ok = app.AcceptDNS.Get()
+	}
+	if ok {
+		prefs.CorpDNS = acceptDNS
+		prefs.CorpDNSSet = true
+	}
+
+	// Invalid service names are rejected by getAdvertiseServices when the node is created.
+	if svcs, err := getAdvertiseServices(name, app); err == nil && len(svcs) > 0 {
+		slices.Sort(svcs)
+		prefs.AdvertiseServices = serviceNames(svcs)
+		prefs.AdvertiseServicesSet = true
+	}
+
+	if !prefs.AdvertiseRoutesSet && !prefs.RouteAllSet && !prefs.CorpDNSSet && !prefs.AdvertiseServicesSet {
+		return nil
+	}
+	return prefs
+}
+
 func getTags(name string, app *App) []string {
 	if node, ok := app.Nodes[name]; ok {
 		if node.Tags != nil {
@@ -415,12 +423,135 @@ func getTags(name string, app *App) []string {
 // This node can listen on the tailscale network interface, or be used to connect to other nodes in the tailnet.
 type tailscaleNode struct {
 	*tsnet.Server
+
+	name   string
+	logger *zap.Logger
+
+	// funnel is true if listeners on the node's Funnel ports should also accept connections over Funnel.
+	funnel bool
+
+	// services are the Tailscale Services the node is configured to advertise.
+	services []tailcfg.ServiceName
+
+	// runningTimeout is how long listeners that need the node to be running wait for it:
+	// the login timeout of the node, or its startup timeout if it waits for running.
+	// If zero, such listeners do not wait, and are set up once the node is running.
+	runningTimeout time.Duration
+
+	// startupTimeout is the startup timeout of the node,
+	// which bounds the wait of listeners that can only be set up once the node is running.
+	startupTimeout time.Duration
+
+	// unlock, if set, releases the lock on the node's state in Caddy storage.
+	unlock func()
+
+	// startMu serializes starting the node, and isStarted is set once it has been started.
+	startMu   sync.Mutex
+	isStarted atomic.Bool
 }
 
-func (t tailscaleNode) Destruct() error {
+func (t *tailscaleNode) Destruct() error {
+	if t.unlock != nil {
+		defer t.unlock()
+	}
+	// tsnet.Server.Close must not be called before the server is started,
+	// which only happens once the node is first used.
+	if !t.started() {
+		return nil
+	}
 	return t.Close()
 }
 
+// started reports whether the node has been started.
+// Methods that access the node's backend, such as TailscaleIPs and CertDomains,
+// must not be called before the node is started.
+// Other methods, such as LocalClient and Listen, start the node if needed.
+func (t *tailscaleNode) started() bool {
+	return t.isStarted.Load()
+}
+
+// start starts the node, if it has not been started yet,
+// and watches its login state until it is running.
+//
+// The node is started by the methods of the wrapper that use its backend,
+// so that whether it has been started is known without reading the state of the tsnet.Server,
+// which is not safe while another goroutine is starting it.
+func (t *tailscaleNode) start() error {
+	if t.isStarted.Load() {
+		return nil
+	}
+	t.startMu.Lock()
+	defer t.startMu.Unlock()
+	if t.isStarted.Load() {
+		return nil
+	}
+	if err := t.Server.Start(); err != nil {
+		return err
+	}
+	t.isStarted.Store(true)
+	go t.watchLogin()
+	return nil
+}
+
+// LocalClient starts the node if needed, and returns a LocalClient for it.
+func (t *tailscaleNode) LocalClient() (*local.Client, error) {
+	if err := t.start(); err != nil {
+		return nil, err
+	}
+	return t.Server.LocalClient()
+}
+
+// Dial starts the node if needed, and dials address through it.
+func (t *tailscaleNode) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := t.start(); err != nil {
+		return nil, err
+	}
+	return t.Server.Dial(ctx, network, address)
+}
+
+// Listen starts the node if needed, and listens on addr of the node.
+func (t *tailscaleNode) Listen(network, addr string) (net.Listener, error) {
+	if err := t.start(); err != nil {
+		return nil, err
+	}
+	return t.Server.Listen(network, addr)
+}
+
+// ListenPacket starts the node if needed, and listens for packets on addr of the node.
+func (t *tailscaleNode) ListenPacket(network, addr string) (net.PacketConn, error) {
+	if err := t.start(); err != nil {
+		return nil, err
+	}
+	return t.Server.ListenPacket(network, addr)
+}
+
+// ListenFunnel starts the node if needed, and listens on addr of the node and over Funnel.
+func (t *tailscaleNode) ListenFunnel(network, addr string, opts ...tsnet.FunnelOption) (net.Listener, error) {
+	if err := t.start(); err != nil {
+		return nil, err
+	}
+	return t.Server.ListenFunnel(network, addr, opts...)
+}
+
+// serveConfigMu serializes changes to the serve config of nodes,
+// which is shared by the Funnel ports and Tailscale Services the nodes are listening on.
+// It is acquired before the mutexes of the funnel and service registries.
+var serveConfigMu sync.Mutex
+
+// editServeConfigLocked applies edit to the serve config of the node of lc.
+// serveConfigMu must be held.
+func editServeConfigLocked(ctx context.Context, lc *local.Client, edit func(sc *ipn.ServeConfig)) error {
+	sc, err := lc.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if sc == nil {
+		sc = new(ipn.ServeConfig)
+	}
+	edit(sc)
+	return lc.SetServeConfig(ctx, sc)
+}
+
 // fakeCloseNode is similar to fakeCloseListener but for node references.
 // It allows listeners to hold references to nodes without affecting the
 // actual node reference count until the listener is truly destroyed.
@@ -437,7 +568,9 @@ func (fcn *fakeCloseNode) Close() error {
 // tailscaleSharedListener is similar to Caddy's sharedListener but for tailscale listeners
 type tailscaleSharedListener struct {
 	net.Listener
-	key string
+	key   string
+	node  string         // name of the node the listener belongs to
+	stats *listenerStats // traffic counters for metrics
 }
 
 func (tsl *tailscaleSharedListener) Destruct() error {
@@ -480,7 +613,9 @@ func (tfcl *tailscaleFakeCloseListener) Unwrap() net.Listener {
 // tailscaleSharedPacketConn is similar to tailscaleSharedListener but for packet connections
 type tailscaleSharedPacketConn struct {
 	net.PacketConn
-	key string
+	key   string
+	node  string         // name of the node the packet conn belongs to
+	stats *listenerStats // traffic counters for metrics
 }
 
 func (tspc *tailscaleSharedPacketConn) Destruct() error {
@@ -535,7 +670,7 @@ func (t *tsnetMuxTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	clientHello, ok := ctx.Value(certmagic.ClientHelloInfoCtxKey).(*tls.ClientHelloInfo)
 	if ok && clientHello != nil {
 		nodes.Range(func(key, value any) bool {
-			if n, ok := value.(*tailscaleNode); ok && n != nil {
+			if n, ok := value.(*tailscaleNode); ok && n != nil && n.started() {
 				for _, d := range n.CertDomains() {
 					// Tailscale doesn't do wildcard certs, but caddy uses MatchWildcard
 					// for the built-in Tailscale cert manager, so we do so here as well.
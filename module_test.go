@@ -4,13 +4,30 @@
 package tscaddy
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"tailscale.com/derp/derpserver"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
 	"tailscale.com/types/opt"
 	"tailscale.com/util/must"
 )
@@ -81,7 +98,7 @@ func Test_GetAuthKey(t *testing.T) {
 				t.Setenv(k, v)
 			}
 
-			got, _ := getAuthKey(host, app)
+			got, _ := getAuthKey(context.Background(), host, app)
 			if got != tt.want {
 				t.Errorf("GetAuthKey() = %v, want %v", got, tt.want)
 			}
@@ -249,6 +266,164 @@ func Test_GetPort(t *testing.T) {
 
 }
 
+func Test_GetLoginTimeout(t *testing.T) {
+	app := &App{
+		LoginTimeout: caddy.Duration(time.Minute),
+		Nodes: map[string]Node{
+			"empty":   {},
+			"timeout": {LoginTimeout: caddy.Duration(time.Second)},
+		},
+	}
+	if err := app.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := getLoginTimeout("noconfig", &App{})
+	if want := time.Duration(0); got != want {
+		t.Errorf("GetLoginTimeout() = %v, want %v", got, want)
+	}
+
+	got = getLoginTimeout("empty", app)
+	if want := time.Minute; got != want {
+		t.Errorf("GetLoginTimeout() = %v, want %v", got, want)
+	}
+
+	got = getLoginTimeout("timeout", app)
+	if want := time.Second; got != want {
+		t.Errorf("GetLoginTimeout() = %v, want %v", got, want)
+	}
+}
+
+func Test_GetWaitForRunning(t *testing.T) {
+	app := &App{
+		WaitForRunning: true,
+		StartupTimeout: caddy.Duration(time.Minute),
+		Nodes: map[string]Node{
+			"empty":   {},
+			"nowait":  {WaitForRunning: opt.NewBool(false)},
+			"timeout": {StartupTimeout: caddy.Duration(time.Second)},
+		},
+	}
+	if err := app.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := getWaitForRunning("noconfig", &App{}), false; got != want {
+		t.Errorf("GetWaitForRunning() = %v, want %v", got, want)
+	}
+	if got, want := getWaitForRunning("empty", app), true; got != want {
+		t.Errorf("GetWaitForRunning() = %v, want %v", got, want)
+	}
+	if got, want := getWaitForRunning("nowait", app), false; got != want {
+		t.Errorf("GetWaitForRunning() = %v, want %v", got, want)
+	}
+
+	// startup timeout defaults when not configured
+	if got, want := getStartupTimeout("noconfig", &App{}), defaultStartupTimeout; got != want {
+		t.Errorf("GetStartupTimeout() = %v, want %v", got, want)
+	}
+	if got, want := getStartupTimeout("empty", app), time.Minute; got != want {
+		t.Errorf("GetStartupTimeout() = %v, want %v", got, want)
+	}
+	if got, want := getStartupTimeout("timeout", app), time.Second; got != want {
+		t.Errorf("GetStartupTimeout() = %v, want %v", got, want)
+	}
+}
+
+func Test_GetPrefs(t *testing.T) {
+	subnet := netip.MustParsePrefix("10.0.0.0/24")
+	other := netip.MustParsePrefix("192.168.0.0/16")
+	app := &App{
+		AdvertiseRoutes: []netip.Prefix{subnet},
+		AcceptRoutes:    opt.NewBool(true),
+		Nodes: map[string]Node{
+			"empty":    {},
+			"override": {AdvertiseRoutes: []netip.Prefix{other}, AcceptRoutes: opt.NewBool(false), AcceptDNS: opt.NewBool(false)},
+			"exit":     {AdvertiseExitNode: opt.NewBool(true)},
+			"noroutes": {AdvertiseRoutes: []netip.Prefix{}},
+			"services": {AdvertiseServices: []string{"web", "svc:api"}},
+		},
+	}
+
+	tests := map[string]struct {
+		app  *App
+		node string
+		want *ipn.MaskedPrefs
+	}{
+		"not configured": {
+			app:  &App{},
+			node: "noconfig",
+			want: nil,
+		},
+		"app defaults": {
+			app:  app,
+			node: "empty",
+			want: &ipn.MaskedPrefs{
+				Prefs:              ipn.Prefs{AdvertiseRoutes: []netip.Prefix{subnet}, RouteAll: true},
+				AdvertiseRoutesSet: true,
+				RouteAllSet:        true,
+			},
+		},
+		"node overrides": {
+			app:  app,
+			node: "override",
+			want: &ipn.MaskedPrefs{
+				Prefs:              ipn.Prefs{AdvertiseRoutes: []netip.Prefix{other}},
+				AdvertiseRoutesSet: true,
+				RouteAllSet:        true,
+				CorpDNSSet:         true,
+			},
+		},
+		"exit node": {
+			app:  app,
+			node: "exit",
+			want: &ipn.MaskedPrefs{
+				Prefs:              ipn.Prefs{AdvertiseRoutes: append([]netip.Prefix{subnet}, tsaddr.ExitRoutes()...), RouteAll: true},
+				AdvertiseRoutesSet: true,
+				RouteAllSet:        true,
+			},
+		},
+		"no routes": {
+			app:  app,
+			node: "noroutes",
+			want: &ipn.MaskedPrefs{
+				Prefs:              ipn.Prefs{AdvertiseRoutes: []netip.Prefix{}, RouteAll: true},
+				AdvertiseRoutesSet: true,
+				RouteAllSet:        true,
+			},
+		},
+		"services": {
+			app:  &App{Nodes: app.Nodes},
+			node: "services",
+			want: &ipn.MaskedPrefs{
+				Prefs:                ipn.Prefs{AdvertiseServices: []string{"svc:api", "svc:web"}},
+				AdvertiseServicesSet: true,
+			},
+		},
+		"app exit node": {
+			app:  &App{AdvertiseExitNode: true},
+			node: "noconfig",
+			want: &ipn.MaskedPrefs{
+				Prefs:              ipn.Prefs{AdvertiseRoutes: tsaddr.ExitRoutes()},
+				AdvertiseRoutesSet: true,
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := getPrefs(tt.node, tt.app)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getPrefs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// the app routes are not modified when exit routes are added
+	if len(app.AdvertiseRoutes) != 1 {
+		t.Errorf("app routes = %v, want unchanged", app.AdvertiseRoutes)
+	}
+}
+
 func Test_GetStateDir(t *testing.T) {
 	const nodeName = "node"
 	configDir := must.Get(os.UserConfigDir())
@@ -429,8 +604,9 @@ func Test_Listen(t *testing.T) {
 	must.Do(caddy.Run(new(caddy.Config)))
 	ctx := caddy.ActiveContext()
 
-	// Test the listener pooling system via getTCPListener
-	ln, err := getTCPListener(ctx, "tailscale", "testhost", "80", 0, net.ListenConfig{})
+	// Test the listener pooling system via the registered tailscale network
+	na := must.Get(caddy.ParseNetworkAddress("tailscale/testhost:80"))
+	ln, err := na.Listen(ctx, 0, net.ListenConfig{})
 	if err != nil {
 		t.Fatal("failed to get listener", err)
 	}
@@ -463,3 +639,126 @@ func Test_Listen(t *testing.T) {
 		t.Fatalf("expected 0 node references after close, got count=%d exists=%v", count, exists)
 	}
 }
+
+func Test_NodeStarted(t *testing.T) {
+	node := &tailscaleNode{Server: &tsnet.Server{
+		Dir:       t.TempDir(),
+		Hostname:  "startednode",
+		Ephemeral: true,
+		Logf:      logger.Discard,
+	}, logger: zap.NewNop()}
+	if node.started() {
+		t.Fatal("started() = true before the node is used")
+	}
+
+	// started is safe to call while the node is being started by another goroutine
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			node.started()
+		}
+	}()
+	if _, err := node.LocalClient(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if !node.started() {
+		t.Error("started() = false after LocalClient")
+	}
+	must.Do(node.Destruct())
+}
+
+func Test_WaitListenableTimeout(t *testing.T) {
+	node := &tailscaleNode{
+		Server: &tsnet.Server{
+			Dir:        t.TempDir(),
+			Hostname:   "listenablenode",
+			Ephemeral:  true,
+			ControlURL: "http://127.0.0.1:1", // never reachable, so the node never runs
+			Logf:       logger.Discard,
+		},
+		name:           "listenablenode",
+		logger:         zap.NewNop(),
+		runningTimeout: 500 * time.Millisecond,
+	}
+	defer node.Destruct()
+
+	errc := make(chan error, 1)
+	go func() { errc <- node.waitListenable() }()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("waitListenable() succeeded for a node that cannot log in")
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("waitListenable() did not return after the running timeout")
+	}
+
+	// nodes without a running timeout are only started
+	node.runningTimeout = 0
+	if err := node.waitListenable(); err != nil {
+		t.Errorf("waitListenable() without a running timeout error = %v", err)
+	}
+	if !node.started() {
+		t.Error("waitListenable() did not start the node")
+	}
+}
+
+// newTestNode returns a node that logs in to a local control server,
+// which grants it HTTPS and Funnel on port 443 and the certificate domain <hostname>.tail-scale.ts.net.
+func newTestNode(t *testing.T, hostname string) *tailscaleNode {
+	t.Helper()
+
+	// nodes are not running until they are connected to a DERP server
+	derp := derpserver.New(key.NewNode(), logger.Discard)
+	derpSrv := httptest.NewUnstartedServer(derpserver.Handler(derp))
+	derpSrv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	derpSrv.StartTLS()
+	t.Cleanup(func() {
+		derpSrv.CloseClientConnections()
+		derpSrv.Close()
+		derp.Close()
+	})
+
+	control := &testcontrol.Server{
+		DERPMap: &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID:   1,
+				RegionCode: "test",
+				Nodes: []*tailcfg.DERPNode{{
+					Name:             "t1",
+					RegionID:         1,
+					HostName:         "127.0.0.1",
+					IPv4:             "127.0.0.1",
+					IPv6:             "none",
+					STUNPort:         -1,
+					DERPPort:         derpSrv.Listener.Addr().(*net.TCPAddr).Port,
+					InsecureForTests: true,
+				}},
+			},
+		}},
+		DNSConfig:      new(tailcfg.DNSConfig),
+		MagicDNSDomain: "tail-scale.ts.net",
+		Logf:           logger.Discard,
+	}
+	control.HTTPTestServer = httptest.NewServer(control)
+	t.Cleanup(control.HTTPTestServer.Close)
+
+	node := &tailscaleNode{
+		Server: &tsnet.Server{
+			Dir:        t.TempDir(),
+			Hostname:   hostname,
+			ControlURL: control.HTTPTestServer.URL,
+			Store:      new(mem.Store),
+			Ephemeral:  true,
+			Logf:       logger.Discard,
+		},
+		name:           hostname,
+		logger:         zap.NewNop(),
+		runningTimeout: 30 * time.Second,
+	}
+	t.Cleanup(func() { node.Destruct() })
+	return node
+}
@@ -0,0 +1,227 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// proxy.go contains the local SOCKS5 and HTTP proxies that let other processes dial through Tailscale nodes.
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"tailscale.com/net/socks5"
+)
+
+// dialFunc dials addr on network, such as with [tsnet.Server.Dial].
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// nodeProxy is a set of local proxies that dial through a node.
+type nodeProxy struct {
+	name      string
+	listeners []net.Listener
+	servers   []*http.Server
+}
+
+// startProxies starts the proxies configured for each node.
+// Each node with proxies is started, and a reference to it is held until the proxies are stopped.
+func (t *App) startProxies() error {
+	for _, name := range slices.Sorted(maps.Keys(t.Nodes)) {
+		node := t.Nodes[name]
+		if node.SOCKS5Listen == "" && node.HTTPProxyListen == "" {
+			continue
+		}
+		if err := t.startProxy(name, node); err != nil {
+			t.stopProxies()
+			return fmt.Errorf("starting proxies for tailscale node %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (t *App) startProxy(name string, conf Node) error {
+	username, err := repl.ReplaceOrErr(conf.ProxyUsername, true, true)
+	if err != nil {
+		return err
+	}
+	password, err := repl.ReplaceOrErr(conf.ProxyPassword, true, true)
+	if err != nil {
+		return err
+	}
+
+	node, err := getNode(t.ctx, name)
+	if err != nil {
+		return err
+	}
+	p := &nodeProxy{name: name}
+	t.proxies = append(t.proxies, p)
+	logger := t.logger.With(zap.String("node", name))
+
+	if conf.SOCKS5Listen != "" {
+		ln, err := listenProxy(t.ctx, conf.SOCKS5Listen)
+		if err != nil {
+			return err
+		}
+		p.listeners = append(p.listeners, ln)
+		s := &socks5.Server{
+			Logf:     func(format string, args ...any) { logger.Sugar().Debugf(format, args...) },
+			Dialer:   node.Dial,
+			Username: username,
+			Password: password,
+		}
+		go func() {
+			if err := s.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Error("SOCKS5 proxy stopped", zap.Error(err))
+			}
+		}()
+		logger.Info("serving SOCKS5 proxy", zap.String("address", conf.SOCKS5Listen))
+	}
+
+	if conf.HTTPProxyListen != "" {
+		ln, err := listenProxy(t.ctx, conf.HTTPProxyListen)
+		if err != nil {
+			return err
+		}
+		p.listeners = append(p.listeners, ln)
+		hs := &http.Server{Handler: httpProxyHandler(node.Dial, username, password)}
+		p.servers = append(p.servers, hs)
+		go func() {
+			if err := hs.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				logger.Error("HTTP proxy stopped", zap.Error(err))
+			}
+		}()
+		logger.Info("serving HTTP proxy", zap.String("address", conf.HTTPProxyListen))
+	}
+	return nil
+}
+
+// stopProxies stops the proxies started by startProxies, and releases their nodes.
+func (t *App) stopProxies() {
+	for _, p := range t.proxies {
+		for _, hs := range p.servers {
+			hs.Close()
+		}
+		for _, ln := range p.listeners {
+			ln.Close()
+		}
+		_, _ = nodes.Delete(p.name)
+	}
+	t.proxies = nil
+}
+
+// listenProxy listens on the Caddy network address addr, such as "localhost:1080".
+// Listeners are shared across config reloads, like those of Caddy servers.
+func listenProxy(ctx caddy.Context, addr string) (net.Listener, error) {
+	na, err := caddy.ParseNetworkAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if na.PortRangeSize() != 1 {
+		return nil, fmt.Errorf("proxy address %s must have a single port", addr)
+	}
+	ln, err := na.Listen(ctx, 0, net.ListenConfig{})
+	if err != nil {
+		return nil, err
+	}
+	l, ok := ln.(net.Listener)
+	if !ok {
+		return nil, fmt.Errorf("proxy address %s is not a stream listener", addr)
+	}
+	return l, nil
+}
+
+// isLoopbackProxyAddr reports whether the Caddy network address addr can only be reached from the local host,
+// such as "localhost:1080", "127.0.0.1:1080", or a unix socket.
+func isLoopbackProxyAddr(addr string) bool {
+	na, err := caddy.ParseNetworkAddress(addr)
+	if err != nil {
+		return false
+	}
+	if na.IsUnixNetwork() || strings.EqualFold(na.Host, "localhost") {
+		return true
+	}
+	ip, err := netip.ParseAddr(na.Host)
+	return err == nil && ip.IsLoopback()
+}
+
+// httpProxyHandler returns an HTTP proxy handler that dials through dial,
+// supporting both CONNECT requests and plain HTTP requests for absolute URLs.
+// If username or password is set, clients must provide them with Proxy-Authorization.
+func httpProxyHandler(dial dialFunc, username, password string) http.Handler {
+	rp := &httputil.ReverseProxy{
+		Rewrite:   func(*httputil.ProxyRequest) {}, // the request URL is already absolute
+		Transport: &http.Transport{DialContext: dial},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (username != "" || password != "") && !checkProxyAuth(r, username, password) {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="tailscale"`)
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+
+		if r.Method != http.MethodConnect {
+			if strings.HasPrefix(r.RequestURI, "/") || r.RequestURI == "*" {
+				http.Error(w, "request must be CONNECT or for an absolute URL", http.StatusBadRequest)
+				return
+			}
+			rp.ServeHTTP(w, r)
+			return
+		}
+
+		backend, err := dial(r.Context(), "tcp", r.RequestURI)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer backend.Close()
+
+		c, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer c.Close()
+
+		if _, err := io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n"); err != nil {
+			return
+		}
+		var client io.Reader = c
+		if buf.Reader.Buffered() > 0 {
+			client = buf
+		}
+
+		errc := make(chan error, 2)
+		go func() {
+			_, err := io.Copy(c, backend)
+			errc <- err
+		}()
+		go func() {
+			_, err := io.Copy(backend, client)
+			errc <- err
+		}()
+		<-errc
+	})
+}
+
+// checkProxyAuth reports whether r has a Proxy-Authorization header with the username and password.
+func checkProxyAuth(r *http.Request, username, password string) bool {
+	auth := &http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}
+	u, p, ok := auth.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+	return userOK && passOK
+}
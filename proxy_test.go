@@ -0,0 +1,128 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"tailscale.com/util/must"
+)
+
+func Test_HTTPProxyHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.Host)
+	}))
+	defer backend.Close()
+
+	// dial the backend for any address, as a node would dial a tailnet address
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		var d net.Dialer
+		return d.DialContext(ctx, network, backend.Listener.Addr().String())
+	}
+	proxy := httptest.NewServer(httpProxyHandler(dial, "user", "pass"))
+	defer proxy.Close()
+
+	tests := map[string]struct {
+		user       *url.Userinfo
+		wantStatus int
+	}{
+		"no credentials":    {wantStatus: http.StatusProxyAuthRequired},
+		"wrong credentials": {user: url.UserPassword("user", "wrong"), wantStatus: http.StatusProxyAuthRequired},
+		"valid credentials": {user: url.UserPassword("user", "pass"), wantStatus: http.StatusOK},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			proxyURL := must.Get(url.Parse(proxy.URL))
+			proxyURL.User = tt.user
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+			resp := must.Get(client.Get("http://myhost.tailnet:8080/"))
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if resp.StatusCode == http.StatusOK {
+				if body := string(must.Get(io.ReadAll(resp.Body))); body != "hello from myhost.tailnet:8080" {
+					t.Errorf("body = %q", body)
+				}
+			}
+		})
+	}
+	if len(dialed) != 1 || dialed[0] != "myhost.tailnet:8080" {
+		t.Errorf("dialed = %v, want [myhost.tailnet:8080]", dialed)
+	}
+}
+
+func Test_HTTPProxyConnect(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunneled")
+	}))
+	defer backend.Close()
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != "myhost:443" {
+			t.Errorf("dial address = %q, want myhost:443", addr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, backend.Listener.Addr().String())
+	}
+	proxy := httptest.NewServer(httpProxyHandler(dial, "", ""))
+	defer proxy.Close()
+
+	c := must.Get(net.Dial("tcp", proxy.Listener.Addr().String()))
+	defer c.Close()
+	io.WriteString(c, "CONNECT myhost:443 HTTP/1.1\r\nHost: myhost:443\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp := must.Get(http.ReadResponse(br, nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+
+	// the connection is now tunneled to the backend
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: myhost\r\n\r\n")
+	resp = must.Get(http.ReadResponse(br, nil))
+	defer resp.Body.Close()
+	if body := string(must.Get(io.ReadAll(resp.Body))); body != "tunneled" {
+		t.Errorf("tunneled body = %q, want %q", body, "tunneled")
+	}
+}
+
+func Test_HTTPProxyRejectsOriginRequests(t *testing.T) {
+	proxy := httptest.NewServer(httpProxyHandler(nil, "", ""))
+	defer proxy.Close()
+
+	resp := must.Get(http.Get(proxy.URL + "/"))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func Test_IsLoopbackProxyAddr(t *testing.T) {
+	tests := map[string]bool{
+		"localhost:1080":         true,
+		"127.0.0.1:1080":         true,
+		"[::1]:1080":             true,
+		"unix//run/proxy.sock":   true,
+		":1080":                  false,
+		"0.0.0.0:1080":           false,
+		"192.168.1.2:1080":       false,
+		"proxy.example.com:1080": false,
+		"tailscale/node:1080":    false,
+	}
+	for addr, want := range tests {
+		if got := isLoopbackProxyAddr(addr); got != want {
+			t.Errorf("isLoopbackProxyAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
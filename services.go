@@ -0,0 +1,389 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// services.go contains support for hosting Tailscale Services on nodes.
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/mak"
+)
+
+// serviceName returns the Tailscale Service name for name,
+// which may omit the "svc:" prefix, such as "web" for "svc:web".
+func serviceName(name string) (tailcfg.ServiceName, error) {
+	if !strings.HasPrefix(name, "svc:") {
+		name = "svc:" + name
+	}
+	svc := tailcfg.ServiceName(name)
+	if err := svc.Validate(); err != nil {
+		return "", err
+	}
+	return svc, nil
+}
+
+// getServiceNode returns the name of the node that hosts the named service.
+// This is the node configured to advertise the service, or the default node if there is none.
+func getServiceNode(host string, app *App) (string, error) {
+	svc, err := serviceName(host)
+	if err != nil {
+		return "", err
+	}
+
+	var found []string
+	for name, node := range app.Nodes {
+		for _, s := range node.AdvertiseServices {
+			if sn, err := serviceName(s); err == nil && sn == svc {
+				found = append(found, name)
+				break
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	default:
+		slices.Sort(found)
+		return "", fmt.Errorf("service %s is advertised by multiple nodes: %v", svc, found)
+	}
+}
+
+// getAdvertiseServices returns the services the named node is configured to advertise.
+func getAdvertiseServices(name string, app *App) ([]tailcfg.ServiceName, error) {
+	node, ok := app.Nodes[name]
+	if !ok {
+		return nil, nil
+	}
+	var svcs []tailcfg.ServiceName
+	for _, s := range node.AdvertiseServices {
+		svc, err := serviceName(s)
+		if err != nil {
+			return nil, err
+		}
+		svcs = append(svcs, svc)
+	}
+	return svcs, nil
+}
+
+// listenService listens on the port of the Tailscale Service named by host.
+// The service is advertised by the node, and connections to the port on any of the service's
+// addresses are accepted, so that multiple nodes, such as those of several Caddy instances,
+// can host the same service.
+func listenService(node *tailscaleNode, host, network, port string) (net.Listener, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("tailscale services only support tcp, not %s", network)
+	}
+	svc, err := serviceName(host)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	// The node must be running for its serve config and prefs to be updated.
+	// If it is not waited for, the service is set up once it is running, by the listener's watch.
+	if err := node.waitListenable(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ln := &serviceListener{
+		node:   node,
+		svc:    svc,
+		port:   uint16(p),
+		conns:  make(chan net.Conn),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	ln.unregister = node.RegisterFallbackTCPHandler(ln.handle)
+
+	if err := services.add(node, svc, ln.port); err != nil {
+		ln.unregister()
+		cancel()
+		return nil, err
+	}
+	go ln.watch()
+	return ln, nil
+}
+
+// serviceListener is a [net.Listener] for the connections to a port of a Tailscale Service hosted by a node.
+//
+// Connections to service addresses are not handled by listeners on the node's own addresses,
+// so they are accepted by a fallback TCP handler registered with the node instead.
+type serviceListener struct {
+	node *tailscaleNode
+	svc  tailcfg.ServiceName
+	port uint16
+
+	// vips are the addresses of the service, which are updated from the node's netmap.
+	vips atomic.Pointer[[]netip.Addr]
+
+	conns      chan net.Conn
+	ctx        context.Context
+	cancel     context.CancelFunc
+	unregister func()
+	closeOnce  sync.Once
+}
+
+// handle is the [tsnet.FallbackTCPHandler] for l.
+func (l *serviceListener) handle(_, dst netip.AddrPort) (func(net.Conn), bool) {
+	if dst.Port() != l.port || !l.isServiceAddr(dst.Addr()) {
+		return nil, false
+	}
+	return func(c net.Conn) {
+		select {
+		case l.conns <- c:
+		case <-l.ctx.Done():
+			c.Close()
+		}
+	}, true
+}
+
+// isServiceAddr reports whether ip is one of the addresses of the service.
+func (l *serviceListener) isServiceAddr(ip netip.Addr) bool {
+	if vips := l.vips.Load(); vips != nil {
+		return slices.Contains(*vips, ip)
+	}
+	return false
+}
+
+func (l *serviceListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return &serviceConn{Conn: c, node: l.node}, nil
+	case <-l.ctx.Done():
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+func (l *serviceListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.unregister()
+		l.cancel()
+		services.remove(l.node, l.svc, l.port)
+	})
+	return nil
+}
+
+// serviceConn is a connection accepted by a [serviceListener].
+// Its local address is an address of the service rather than of the node,
+// so it carries the node that accepted it for identifying its peer.
+type serviceConn struct {
+	net.Conn
+	node *tailscaleNode
+}
+
+// NetConn returns the underlying connection.
+func (c *serviceConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Addr returns the first address of the service, or an unspecified address if it is not yet known.
+func (l *serviceListener) Addr() net.Addr {
+	var ip netip.Addr
+	if vips := l.vips.Load(); vips != nil && len(*vips) > 0 {
+		ip = (*vips)[0]
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, l.port))
+}
+
+// watch updates the addresses of the service whenever the node receives a new netmap, until l is closed.
+func (l *serviceListener) watch() {
+	for l.ctx.Err() == nil {
+		if err := l.watchOnce(); err != nil && l.ctx.Err() == nil {
+			l.node.logger.Debug("stopped watching IPN bus for Tailscale Service address changes",
+				zap.String("node", l.node.name), zap.String("service", string(l.svc)), zap.Error(err))
+		}
+
+		select {
+		case <-l.ctx.Done():
+		case <-time.After(ipnBusRetryInterval):
+		}
+	}
+}
+
+func (l *serviceListener) watchOnce() error {
+	lc, err := l.node.LocalClient()
+	if err != nil {
+		return err
+	}
+	watcher, err := lc.WatchIPNBus(l.ctx, ipn.NotifyInitialState|ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	var running, applied bool
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return err
+		}
+		if n.State != nil {
+			running = *n.State == ipn.Running
+		}
+		if running && !applied {
+			// the node may not have been running when the listener was added
+			serveConfigMu.Lock()
+			err := services.reapply(l.node)
+			serveConfigMu.Unlock()
+			if err != nil {
+				l.node.logger.Warn("unable to update tailscale services", zap.String("node", l.node.name), zap.Error(err))
+			}
+			applied = true
+		}
+		if n.NetMap == nil {
+			continue
+		}
+
+		vips := n.NetMap.GetVIPServiceIPMap()[l.svc]
+		if old := l.vips.Swap(&vips); old == nil || !slices.Equal(*old, vips) {
+			if len(vips) == 0 {
+				l.node.logger.Warn("tailscale service has no addresses, it may need to be approved by a tailnet admin",
+					zap.String("node", l.node.name), zap.String("service", string(l.svc)))
+			} else {
+				l.node.logger.Info("tailscale service addresses updated",
+					zap.String("node", l.node.name), zap.String("service", string(l.svc)), zap.Any("addresses", vips))
+			}
+		}
+	}
+}
+
+// services tracks the Tailscale Service ports that nodes are listening on.
+var services = &serviceRegistry{ports: make(map[*tailscaleNode]map[tailcfg.ServiceName][]uint16)}
+
+type serviceRegistry struct {
+	mu    sync.Mutex
+	ports map[*tailscaleNode]map[tailcfg.ServiceName][]uint16
+}
+
+// add adds port to the ports of the service hosted by node,
+// and updates the node's serve config and advertised services.
+func (r *serviceRegistry) add(node *tailscaleNode, svc tailcfg.ServiceName, port uint16) error {
+	serveConfigMu.Lock()
+	defer serveConfigMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ports[node] == nil {
+		r.ports[node] = make(map[tailcfg.ServiceName][]uint16)
+	}
+	if !slices.Contains(r.ports[node][svc], port) {
+		r.ports[node][svc] = append(r.ports[node][svc], port)
+	}
+	return r.updateLocked(node)
+}
+
+// remove removes port from the ports of the service hosted by node,
+// and updates the node's serve config and advertised services.
+func (r *serviceRegistry) remove(node *tailscaleNode, svc tailcfg.ServiceName, port uint16) {
+	serveConfigMu.Lock()
+	defer serveConfigMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ports := slices.DeleteFunc(r.ports[node][svc], func(p uint16) bool { return p == port })
+	if len(ports) == 0 {
+		delete(r.ports[node], svc)
+	} else {
+		r.ports[node][svc] = ports
+	}
+	if len(r.ports[node]) == 0 {
+		delete(r.ports, node)
+	}
+	if err := r.updateLocked(node); err != nil {
+		node.logger.Warn("unable to update tailscale services", zap.String("node", node.name), zap.Error(err))
+	}
+}
+
+// reapply sets the services in the node's serve config again, if the node is listening on any,
+// such as once the node is running, or after the serve config was reset by [tsnet.Server.ListenFunnel].
+// serveConfigMu must be held.
+func (r *serviceRegistry) reapply(node *tailscaleNode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.ports[node]) == 0 {
+		return nil
+	}
+	return r.updateLocked(node)
+}
+
+// updateLocked sets the services in the node's serve config to the services and ports the node is listening on,
+// and advertises them along with the services the node is configured to advertise.
+// serveConfigMu and r.mu must be held.
+func (r *serviceRegistry) updateLocked(node *tailscaleNode) error {
+	if !node.started() {
+		return nil
+	}
+	lc, err := node.LocalClient()
+	if err != nil {
+		return err
+	}
+
+	// The serve config can only be set once the node is running,
+	// after which the services are set by reapply.
+	ctx := context.Background()
+	st, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		return err
+	}
+	if st.BackendState != ipn.Running.String() {
+		return nil
+	}
+
+	listening := r.ports[node]
+	err = editServeConfigLocked(ctx, lc, func(sc *ipn.ServeConfig) {
+		sc.Services = nil
+		for svc, ports := range listening {
+			// Ports without a handler are intercepted for the service,
+			// but connections are left to the node's listeners.
+			conf := new(ipn.ServiceConfig)
+			for _, port := range ports {
+				mak.Set(&conf.TCP, port, new(ipn.TCPPortHandler))
+			}
+			mak.Set(&sc.Services, svc, conf)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	advertise := slices.Collect(maps.Keys(listening))
+	for _, svc := range node.services {
+		if !slices.Contains(advertise, svc) {
+			advertise = append(advertise, svc)
+		}
+	}
+	slices.Sort(advertise)
+	_, err = lc.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs:                ipn.Prefs{AdvertiseServices: serviceNames(advertise)},
+		AdvertiseServicesSet: true,
+	})
+	return err
+}
+
+// serviceNames returns svcs as strings.
+func serviceNames(svcs []tailcfg.ServiceName) []string {
+	names := make([]string, 0, len(svcs))
+	for _, svc := range svcs {
+		names = append(names, string(svc))
+	}
+	return names
+}
@@ -0,0 +1,149 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+	"tailscale.com/util/must"
+)
+
+func Test_ServiceName(t *testing.T) {
+	tests := map[string]struct {
+		name    string
+		want    tailcfg.ServiceName
+		wantErr bool
+	}{
+		"prefixed":     {name: "svc:web", want: "svc:web"},
+		"bare":         {name: "web", want: "svc:web"},
+		"invalid name": {name: "Not_Valid", wantErr: true},
+		"empty":        {name: "", wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := serviceName(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("serviceName(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("serviceName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_GetServiceNode(t *testing.T) {
+	app := &App{
+		Nodes: map[string]Node{
+			"a": {AdvertiseServices: []string{"svc:web"}},
+			"b": {AdvertiseServices: []string{"api", "svc:shared"}},
+			"c": {AdvertiseServices: []string{"shared"}},
+		},
+	}
+	tests := map[string]struct {
+		host    string
+		want    string
+		wantErr bool
+	}{
+		"prefixed config":  {host: "web", want: "a"},
+		"bare config":      {host: "api", want: "b"},
+		"default node":     {host: "other", want: ""},
+		"multiple nodes":   {host: "shared", wantErr: true},
+		"invalid service":  {host: "Not_Valid", wantErr: true},
+		"prefixed address": {host: "svc:web", want: "a"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := getServiceNode(tt.host, app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getServiceNode(%q) error = %v, wantErr %v", tt.host, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getServiceNode(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ServiceListener(t *testing.T) {
+	vip := netip.MustParseAddr("100.100.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	ln := &serviceListener{
+		node:       &tailscaleNode{Server: new(tsnet.Server)},
+		svc:        "svc:web",
+		port:       443,
+		conns:      make(chan net.Conn),
+		ctx:        ctx,
+		cancel:     cancel,
+		unregister: func() {},
+	}
+
+	// connections are not handled until the service addresses are known
+	dst := netip.AddrPortFrom(vip, 443)
+	if _, ok := ln.handle(netip.AddrPort{}, dst); ok {
+		t.Error("handle() before addresses are known intercepted the flow")
+	}
+	ln.vips.Store(&[]netip.Addr{vip})
+	if got := ln.Addr().String(); got != dst.String() {
+		t.Errorf("Addr() = %v, want %v", got, dst)
+	}
+
+	if _, ok := ln.handle(netip.AddrPort{}, netip.AddrPortFrom(vip, 80)); ok {
+		t.Error("handle() on another port intercepted the flow")
+	}
+	if _, ok := ln.handle(netip.AddrPort{}, netip.MustParseAddrPort("100.64.0.1:443")); ok {
+		t.Error("handle() on another address intercepted the flow")
+	}
+
+	handler, ok := ln.handle(netip.AddrPort{}, dst)
+	if !ok {
+		t.Fatal("handle() on the service address did not intercept the flow")
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go handler(c1)
+	if c, ok := must.Get(ln.Accept()).(*serviceConn); !ok || c.Conn != c1 || c.node != ln.node {
+		t.Errorf("Accept() = %v, want the handled conn with the listener's node", c)
+	}
+
+	must.Do(ln.Close())
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() after close error = %v, want net.ErrClosed", err)
+	}
+}
+
+func Test_ListenServiceBeforeRunning(t *testing.T) {
+	node := newTestNode(t, "svchost")
+	node.runningTimeout = 0
+
+	// the listener is created without waiting for the node to log in,
+	// and the service is set up once it is running
+	ln := must.Get(listenService(node, "svc:web", "tcp", "80"))
+	defer ln.Close()
+
+	lc := must.Get(node.LocalClient())
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		sc, err := lc.GetServeConfig(context.Background())
+		if err == nil && sc.Services["svc:web"] != nil && sc.Services["svc:web"].TCP[80] != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("serve config = %v, %v, want svc:web on port 80", sc, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	prefs := must.Get(lc.GetPrefs(context.Background()))
+	if !slices.Equal(prefs.AdvertiseServices, []string{"svc:web"}) {
+		t.Errorf("AdvertiseServices = %v, want [svc:web]", prefs.AdvertiseServices)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// statestore.go contains the state stores that nodes can keep their Tailscale state in.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+)
+
+const (
+	// stateStoreFile stores node state in a file in the node's state directory. This is the default.
+	stateStoreFile = "file"
+
+	// stateStoreCaddyStorage stores node state in Caddy's configured storage module,
+	// so that nodes keep their identity when Caddy moves between hosts that share the storage.
+	stateStoreCaddyStorage = "caddy_storage"
+)
+
+// storageTimeout is the maximum time to wait for Caddy's storage to read or write node state.
+const storageTimeout = 30 * time.Second
+
+// storageStateStore is an [ipn.StateStore] that stores the state of a node in a [certmagic.Storage].
+// Each state key of the node is stored as a separate storage key under "tailscale/<node name>".
+// The state is only written by the Caddy instance that holds the node's lease, which is taken by lock.
+type storageStateStore struct {
+	storage certmagic.Storage
+	prefix  string
+}
+
+func newStorageStateStore(storage certmagic.Storage, name string) *storageStateStore {
+	return &storageStateStore{storage: storage, prefix: path.Join("tailscale", name)}
+}
+
+func (s *storageStateStore) key(id ipn.StateKey) string {
+	return path.Join(s.prefix, string(id))
+}
+
+func (s *storageStateStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	b, err := s.storage.Load(ctx, s.key(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ipn.ErrStateNotExist
+	}
+	return b, err
+}
+
+func (s *storageStateStore) WriteState(id ipn.StateKey, bs []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	return s.storage.Store(ctx, s.key(id), bs)
+}
+
+// leaseDuration is how long the lease of an instance on a node lasts unless it is renewed.
+// If an instance stops without releasing its lease, such as when it crashes,
+// other instances can run the node once the lease expires.
+const leaseDuration = 30 * time.Second
+
+// leaseRetryInterval is how often an instance waiting to run a node checks whether the node's lease is available.
+const leaseRetryInterval = time.Second
+
+// stateLease is the lease of the Caddy instance that is running a node, which is stored alongside the node's state.
+type stateLease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// leaseKey is the storage key of the node's lease.
+func (s *storageStateStore) leaseKey() string {
+	return path.Join(s.prefix, "caddy-lease")
+}
+
+// lockName is the name of the storage lock that is held while the node's lease is read or updated.
+func (s *storageStateStore) lockName() string {
+	return path.Join(s.prefix, "node")
+}
+
+// lock waits until no other Caddy instance is running the node, until ctx is done,
+// and returns a function that releases the lock.
+//
+// Storage locks are meant to be held briefly, and some storage modules expire locks that are held for long,
+// so the lock is instead a lease stored in the storage, which is renewed until it is released.
+// The node's state is only written by the instance holding the lease,
+// so reads and writes of the state itself are not locked.
+func (s *storageStateStore) lock(ctx context.Context, logger *zap.Logger) (func(), error) {
+	owner := rand.Text()
+	for {
+		ok, err := s.updateLease(ctx, owner, time.Now().Add(leaseDuration))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for lease: %w", ctx.Err())
+		case <-time.After(leaseRetryInterval):
+		}
+	}
+
+	renewCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.renewLease(renewCtx, owner, logger)
+	}()
+	return func() {
+		cancel()
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+		defer cancel()
+		_, _ = s.updateLease(ctx, owner, time.Time{})
+	}, nil
+}
+
+// renewLease renews the lease of owner on the node until ctx is done.
+func (s *storageStateStore) renewLease(ctx context.Context, owner string, logger *zap.Logger) {
+	ticker := time.NewTicker(leaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		renewCtx, cancel := context.WithTimeout(ctx, storageTimeout)
+		ok, err := s.updateLease(renewCtx, owner, time.Now().Add(leaseDuration))
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			logger.Warn("unable to renew lease on tailscale node state", zap.String("store", s.String()), zap.Error(err))
+		} else if err == nil && !ok {
+			logger.Error("lease on tailscale node state was taken by another Caddy instance", zap.String("store", s.String()))
+		}
+	}
+}
+
+// updateLease sets the lease of owner on the node to expire at expires, or releases it if expires is zero,
+// and reports whether owner holds the lease.
+// It returns false without updating the lease if another owner holds an unexpired lease.
+func (s *storageStateStore) updateLease(ctx context.Context, owner string, expires time.Time) (bool, error) {
+	if err := s.storage.Lock(ctx, s.lockName()); err != nil {
+		return false, err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+		defer cancel()
+		_ = s.storage.Unlock(ctx, s.lockName())
+	}()
+
+	var lease stateLease
+	b, err := s.storage.Load(ctx, s.leaseKey())
+	if err == nil {
+		err = json.Unmarshal(b, &lease)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if lease.Owner != owner && time.Now().Before(lease.Expires) {
+		return false, nil
+	}
+
+	if expires.IsZero() {
+		if lease.Owner != owner {
+			return false, nil
+		}
+		return false, s.storage.Delete(ctx, s.leaseKey())
+	}
+	b, err = json.Marshal(stateLease{Owner: owner, Expires: expires})
+	if err != nil {
+		return false, err
+	}
+	return true, s.storage.Store(ctx, s.leaseKey(), b)
+}
+
+func (s *storageStateStore) String() string {
+	return fmt.Sprintf("caddy_storage:%s", s.prefix)
+}
+
+// getStateStore returns the kind of state store used by the named node.
+func getStateStore(name string, app *App) string {
+	if node, ok := app.Nodes[name]; ok {
+		if node.StateStore != "" {
+			return node.StateStore
+		}
+	}
+	if app.StateStore != "" {
+		return app.StateStore
+	}
+	return stateStoreFile
+}
+
+// isRegistered reports whether the named node has already been registered,
+// in which case its existing state is used to log in.
+func isRegistered(ctx context.Context, name string, app *App) (bool, error) {
+	switch kind := getStateStore(name, app); kind {
+	case stateStoreCaddyStorage:
+		cctx, ok := ctx.(caddy.Context)
+		if !ok {
+			return false, fmt.Errorf("context is not a caddy.Context: %T", ctx)
+		}
+		b, err := newStorageStateStore(cctx.Storage(), name).ReadState(ipn.CurrentProfileStateKey)
+		if errors.Is(err, ipn.ErrStateNotExist) {
+			return false, nil
+		}
+		return len(b) > 0, err
+	case stateStoreFile:
+		dir, err := getStateDir(name, app)
+		if err != nil {
+			return false, err
+		}
+		fi, err := os.Stat(filepath.Join(dir, "tailscaled.state"))
+		return err == nil && fi.Size() > 0, nil
+	default:
+		return false, fmt.Errorf("unknown state store %q", kind)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	_ "github.com/caddyserver/caddy/v2/modules/filestorage"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+	"tailscale.com/util/must"
+)
+
+func Test_StorageStateStore(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	store := newStorageStateStore(storage, "node")
+
+	if _, err := store.ReadState(ipn.MachineKeyStateKey); !errors.Is(err, ipn.ErrStateNotExist) {
+		t.Fatalf("ReadState() of missing key error = %v, want ipn.ErrStateNotExist", err)
+	}
+	must.Do(ipn.WriteState(store, ipn.MachineKeyStateKey, []byte("key")))
+	if got := string(must.Get(store.ReadState(ipn.MachineKeyStateKey))); got != "key" {
+		t.Errorf("ReadState() = %q, want %q", got, "key")
+	}
+	if !storage.Exists(context.Background(), "tailscale/node/_machinekey") {
+		t.Error("state is not stored under the node's prefix")
+	}
+
+	// state of other nodes is separate
+	other := newStorageStateStore(storage, "other")
+	if _, err := other.ReadState(ipn.MachineKeyStateKey); !errors.Is(err, ipn.ErrStateNotExist) {
+		t.Errorf("ReadState() of other node error = %v, want ipn.ErrStateNotExist", err)
+	}
+}
+
+func Test_StorageStateStoreLock(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	store := newStorageStateStore(storage, "node")
+
+	unlock := must.Get(store.lock(context.Background(), zap.NewNop()))
+
+	// another instance can't run the node while it is locked
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := newStorageStateStore(storage, "node").lock(ctx, zap.NewNop()); err == nil {
+		t.Fatal("lock() of locked node succeeded, want error")
+	}
+
+	// but can run other nodes
+	unlockOther := must.Get(newStorageStateStore(storage, "other").lock(context.Background(), zap.NewNop()))
+	unlockOther()
+
+	unlock()
+	unlock = must.Get(newStorageStateStore(storage, "node").lock(context.Background(), zap.NewNop()))
+	unlock()
+}
+
+func Test_StorageStateStoreLease(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	store := newStorageStateStore(storage, "node")
+	ctx := context.Background()
+
+	// an expired lease, such as of an instance that crashed, can be taken
+	expired := must.Get(json.Marshal(stateLease{Owner: "crashed", Expires: time.Now().Add(-time.Second)}))
+	must.Do(storage.Store(ctx, store.leaseKey(), expired))
+	if ok := must.Get(store.updateLease(ctx, "a", time.Now().Add(leaseDuration))); !ok {
+		t.Fatal("updateLease() of expired lease = false, want true")
+	}
+
+	// an unexpired lease can only be renewed or released by its owner
+	if ok := must.Get(store.updateLease(ctx, "b", time.Now().Add(leaseDuration))); ok {
+		t.Error("updateLease() of another owner's lease = true, want false")
+	}
+	must.Get(store.updateLease(ctx, "b", time.Time{}))
+	if !storage.Exists(ctx, store.leaseKey()) {
+		t.Error("lease was released by another owner")
+	}
+	if ok := must.Get(store.updateLease(ctx, "a", time.Now().Add(leaseDuration))); !ok {
+		t.Error("updateLease() renewal by owner = false, want true")
+	}
+	must.Get(store.updateLease(ctx, "a", time.Time{}))
+	if storage.Exists(ctx, store.leaseKey()) {
+		t.Error("lease was not released by its owner")
+	}
+}
+
+func Test_IsRegistered(t *testing.T) {
+	storageDir := t.TempDir()
+	must.Do(caddy.Run(&caddy.Config{
+		StorageRaw: must.Get(json.Marshal(map[string]string{"module": "file_system", "root": storageDir})),
+	}))
+	ctx := caddy.ActiveContext()
+
+	stateDir := t.TempDir()
+	must.Do(os.MkdirAll(filepath.Join(stateDir, "filenode"), 0700))
+	must.Do(os.WriteFile(filepath.Join(stateDir, "filenode", "tailscaled.state"), []byte("{}"), 0600))
+	must.Do(newStorageStateStore(ctx.Storage(), "storagenode").WriteState(ipn.CurrentProfileStateKey, []byte("profile")))
+
+	app := &App{
+		StateDir: stateDir,
+		Nodes: map[string]Node{
+			"storagenode":  {StateStore: stateStoreCaddyStorage},
+			"newstorage":   {StateStore: stateStoreCaddyStorage},
+			"invalidstore": {StateStore: "memory"},
+		},
+	}
+	tests := map[string]struct {
+		want    bool
+		wantErr bool
+	}{
+		"filenode":     {want: true},
+		"newfile":      {want: false},
+		"storagenode":  {want: true},
+		"newstorage":   {want: false},
+		"invalidstore": {wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := isRegistered(ctx, name, app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("isRegistered() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("isRegistered() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
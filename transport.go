@@ -6,11 +6,24 @@ package tscaddy
 // transport.go contains the Transport module.
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
 )
 
 func init() {
@@ -18,14 +31,43 @@ func init() {
 }
 
 // Transport is a caddy transport that uses a tailscale node to make requests.
+//
+// It supports the same options as Caddy's http transport, such as timeouts, keepalives,
+// HTTP versions, and TLS, except for those that only apply to dialing from the local host.
 type Transport struct {
 	Name string `json:"name,omitempty"`
 
+	// ForwardIdentity is a secret that the Tailscale identity of the downstream client of each request
+	// is signed with, and sent to the upstream in the Tailscale-Identity header.
+	// Upstreams that trust this node as a proxy with the same secret authenticate the forwarded identity.
+	// Requests from clients that are not tailnet peers are sent without an identity.
+	ForwardIdentity string `json:"forward_identity,omitempty"`
+
+	// HTTPTransport configures the HTTP transport,
+	// whose connections are dialed through the node.
+	reverseproxy.HTTPTransport
+
 	node *tailscaleNode
 
-	// A non-nil TLS config enables TLS.
-	// We do not currently use the config values for anything.
-	TLS *reverseproxy.TLSConfig `json:"tls,omitempty"`
+	// dialNode dials through the node. It is the node's Dial method, except in tests.
+	dialNode dialFunc
+
+	// h2c is the transport used for HTTP/2 over cleartext, if enabled.
+	h2c *http2.Transport
+
+	// identitySecret is ForwardIdentity with placeholders replaced.
+	identitySecret string
+
+	// signer is the node and its identity key, once they are known.
+	signer atomic.Pointer[identitySigner]
+
+	logger *zap.Logger
+}
+
+// identitySigner is the key that a proxy node signs forwarded identities with.
+type identitySigner struct {
+	issuer identityIssuer
+	key    []byte
 }
 
 func (t *Transport) CaddyModule() caddy.ModuleInfo {
@@ -37,11 +79,16 @@ func (t *Transport) CaddyModule() caddy.ModuleInfo {
 
 // UnmarshalCaddyfile populates a Transport config from a caddyfile.
 //
-// We only support a single token identifying the name of a node in the App config.
+// The transport takes an optional token identifying the name of a node in the App config,
+// and a block with the same subdirectives as the http transport, as well as forward_identity.
 // For example:
 //
 //	reverse_proxy {
-//	  transport tailscale my-node
+//	  transport tailscale my-node {
+//	    dial_timeout 10s
+//	    tls_server_name example.com
+//	    forward_identity {env.TS_IDENTITY_SECRET}
+//	  }
 //	}
 //
 // If a node name is not specified, a default name is used.
@@ -49,47 +96,273 @@ func (t *Transport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	const defaultNodeName = "caddy-proxy"
 
 	d.Next() // skip transport name
+	nameToken := d.Token()
 	if d.NextArg() {
 		t.Name = d.Val()
 	} else {
 		t.Name = defaultNodeName
 	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
 
-	return nil
+	// The remaining subdirectives are parsed by the http transport,
+	// from a block with the same tokens except for those of this transport.
+	tokens := []caddyfile.Token{nameToken}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if len(tokens) == 1 {
+			// include the opening brace, which NextBlock consumed
+			d.Prev()
+			tokens = append(tokens, d.Token())
+			d.Next()
+		}
+		switch d.Val() {
+		case "forward_identity":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.ForwardIdentity = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			tokens = append(tokens, d.NextSegment()...)
+		}
+	}
+	if len(tokens) > 1 {
+		// include the closing brace
+		tokens = append(tokens, d.Token())
+	}
+	return t.HTTPTransport.UnmarshalCaddyfile(caddyfile.NewDispenser(tokens))
 }
 
 func (t *Transport) Provision(ctx caddy.Context) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	t.logger = ctx.Logger()
+
 	var err error
+	if t.ForwardIdentity != "" {
+		t.identitySecret, err = repl.ReplaceOrErr(t.ForwardIdentity, true, true)
+		if err != nil {
+			return fmt.Errorf("forward_identity: %w", err)
+		}
+		// Clients are identified the same way as by the tailscale_auth provider.
+		registerLocalClientConnContext(ctx)
+		registerFunnelConnContext(ctx)
+	}
+
 	t.node, err = getNode(ctx, t.Name)
-	return err
+	if err != nil {
+		return err
+	}
+	t.dialNode = t.node.Dial
+
+	// The http transport defaults to a short dial timeout,
+	// which is too short for a node that is still connecting to the tailnet,
+	// so only use a dial timeout if one is configured.
+	dialTimeout := time.Duration(t.DialTimeout)
+	if err := t.HTTPTransport.Provision(ctx); err != nil {
+		return err
+	}
+	t.DialTimeout = caddy.Duration(dialTimeout)
+
+	rt := t.Transport
+	rt.DialContext = t.dial
+	if len(t.NetworkProxyRaw) == 0 {
+		// Tailnet addresses should not be sent to a proxy configured in the environment.
+		rt.Proxy = nil
+	}
+	if rt.DialTLSContext != nil {
+		// The TLS server name has placeholders, which are replaced for each connection.
+		rt.DialTLSContext = t.dialTLS
+	}
+	if slices.Contains(t.Versions, "h2c") {
+		t.h2c = &http2.Transport{
+			// for plaintext requests, pretend to dial TLS
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return t.dial(ctx, network, addr)
+			},
+			AllowHTTP: true,
+		}
+		if t.Compression != nil {
+			t.h2c.DisableCompression = !*t.Compression
+		}
+	}
+	return nil
+}
+
+// validate returns an error if the transport uses http transport options
+// that do not apply to connections dialed through a node.
+func (t *Transport) validate() error {
+	switch {
+	case t.LocalAddress != "":
+		return errors.New("local_address is not supported by the tailscale transport")
+	case t.Resolver != nil:
+		return errors.New("resolvers are not supported by the tailscale transport")
+	case t.ProxyProtocol != "":
+		return errors.New("proxy_protocol is not supported by the tailscale transport")
+	case t.ReadTimeout != 0 || t.WriteTimeout != 0:
+		return errors.New("read_timeout and write_timeout are not supported by the tailscale transport")
+	case slices.Contains(t.Versions, "3"):
+		return errors.New("HTTP/3 is not supported by the tailscale transport")
+	}
+	return nil
+}
+
+// dial dials the upstream chosen by the reverse proxy through the node.
+//
+// The upstream is taken from the dial info of the request, which is also set for health checks,
+// so that load balancing and dynamic upstreams select exactly the backend that is dialed.
+// addr is only used if there is no dial info, or if a network proxy is dialed instead.
+func (t *Transport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dialInfo, ok := reverseproxy.GetDialInfo(ctx); ok && t.Transport.Proxy == nil {
+		if strings.HasPrefix(dialInfo.Network, "unix") {
+			return nil, fmt.Errorf("%s upstreams are not supported by the tailscale transport: %s", dialInfo.Network, dialInfo)
+		}
+		if dialInfo.Network != "" {
+			network = dialInfo.Network
+		}
+		addr = dialInfo.Address
+	}
+
+	if t.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t.DialTimeout))
+		defer cancel()
+	}
+	conn, err := t.dialNode(ctx, network, addr)
+	if err != nil {
+		return nil, dialError(err)
+	}
+	return conn, nil
+}
+
+// dialError returns err as a [reverseproxy.DialError], which the reverse proxy retries
+// even for requests that are not idempotent, since the request was never sent.
+// The error of a DialError is unexported, so it is set through the struct's only field.
+func dialError(err error) error {
+	var de reverseproxy.DialError
+	*(*error)(unsafe.Pointer(&de)) = err
+	return de
+}
+
+// dialTLS dials addr through the node, and completes a TLS handshake
+// using the TLS server name with its placeholders replaced.
+func (t *Transport) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := t.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := t.Transport.TLSClientConfig.Clone()
+	if repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		tlsConfig.ServerName = repl.ReplaceAll(tlsConfig.ServerName, "")
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+
+	if timeout := t.Transport.TLSHandshakeTimeout; timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = tlsConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
 }
 
 func (t *Transport) Cleanup() error {
-	// Decrement usage count of this node.
-	_, err := nodes.Delete(t.Name)
-	return err
+	_ = t.HTTPTransport.Cleanup()
+	if t.h2c != nil {
+		t.h2c.CloseIdleConnections()
+	}
+	return releaseNode(t.Name, t.node)
 }
 
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if req.URL.Scheme == "" {
-		if t.TLSEnabled() {
-			req.URL.Scheme = "https"
-		} else {
-			req.URL.Scheme = "http"
-		}
+	t.SetScheme(req)
+	if t.identitySecret != "" {
+		t.setIdentityHeader(req)
 	}
-	return t.node.HTTPClient().Transport.RoundTrip(req)
+
+	// if H2C ("HTTP/2 over cleartext") is enabled and the upstream request is
+	// HTTP without TLS, use the H2C-capable transport instead
+	if req.URL.Scheme == "http" && t.h2c != nil {
+		req.Close = t.Transport.DisableKeepAlives
+		return t.h2c.RoundTrip(req)
+	}
+	return t.Transport.RoundTrip(req)
 }
 
-// TLSEnabled returns true if TLS is enabled.
-func (h Transport) TLSEnabled() bool {
-	return h.TLS != nil
+// setIdentityHeader sets the identity header of req to the signed identity of the downstream client,
+// replacing any identity header sent by the client.
+// If the client cannot be identified, such as if it is not a tailnet peer, the header is removed.
+func (t *Transport) setIdentityHeader(req *http.Request) {
+	req.Header.Del(identityHeader)
+
+	ctx := req.Context()
+	if isFunnelRequest(req) {
+		return
+	}
+	remoteAddr := req.RemoteAddr
+	if orig, ok := ctx.Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok && orig.RemoteAddr != "" {
+		remoteAddr = orig.RemoteAddr
+	}
+
+	client, err := localClientForRequest(req)
+	if err != nil {
+		t.logger.Debug("unable to identify client for forwarded identity", zap.String("remote_addr", remoteAddr), zap.Error(err))
+		return
+	}
+	info, err := timedWhoIs(ctx, client, remoteAddr)
+	if err != nil {
+		// the client is not a tailnet peer, or its identity is unknown
+		t.logger.Debug("unable to identify client for forwarded identity", zap.String("remote_addr", remoteAddr), zap.Error(err))
+		return
+	}
+
+	signer, err := t.identitySigner(ctx)
+	if err != nil {
+		t.logger.Warn("unable to sign forwarded identity", zap.String("node", t.Name), zap.Error(err))
+		return
+	}
+	token, err := signIdentity(newIdentityClaims(info, signer.issuer, time.Now()), signer.key)
+	if err != nil {
+		t.logger.Warn("unable to sign forwarded identity", zap.String("node", t.Name), zap.Error(err))
+		return
+	}
+	req.Header.Set(identityHeader, token)
 }
 
-// EnableTLS enables TLS on the transport.
-func (h *Transport) EnableTLS(config *reverseproxy.TLSConfig) error {
-	h.TLS = config
-	return nil
+// identitySigner returns the signer of forwarded identities,
+// which is derived from the fully qualified name of the node once it is known.
+func (t *Transport) identitySigner(ctx context.Context) (*identitySigner, error) {
+	if signer := t.signer.Load(); signer != nil {
+		return signer, nil
+	}
+
+	lc, err := t.node.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	st, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if st.Self == nil || st.Self.ID == "" || st.Self.DNSName == "" {
+		return nil, errors.New("node ID and name are not yet known")
+	}
+	issuer := identityIssuer{ID: st.Self.ID, Name: st.Self.DNSName}
+	key, err := identityKey(t.identitySecret, issuer)
+	if err != nil {
+		return nil, err
+	}
+	signer := &identitySigner{issuer: issuer, key: key}
+	t.signer.Store(signer)
+	return signer, nil
 }
 
 var (
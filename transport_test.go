@@ -0,0 +1,241 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"tailscale.com/util/must"
+)
+
+func Test_TransportUnmarshalCaddyfile(t *testing.T) {
+	tests := map[string]struct {
+		input       string
+		wantName    string
+		wantTimeout time.Duration
+		wantTLS     bool
+		wantForward string
+		wantErr     bool
+	}{
+		"default node": {
+			input:    `tailscale`,
+			wantName: "caddy-proxy",
+		},
+		"named node": {
+			input:    `tailscale myhost`,
+			wantName: "myhost",
+		},
+		"default node with options": {
+			input: `tailscale {
+				dial_timeout 10s
+			}`,
+			wantName:    "caddy-proxy",
+			wantTimeout: 10 * time.Second,
+		},
+		"named node with options": {
+			input: `tailscale myhost {
+				dial_timeout 5s
+				tls_server_name example.com
+			}`,
+			wantName:    "myhost",
+			wantTimeout: 5 * time.Second,
+			wantTLS:     true,
+		},
+		"forward identity": {
+			input: `tailscale myhost {
+				dial_timeout 5s
+				forward_identity {env.SECRET}
+				tls
+			}`,
+			wantName:    "myhost",
+			wantTimeout: 5 * time.Second,
+			wantTLS:     true,
+			wantForward: "{env.SECRET}",
+		},
+		"forward identity only": {
+			input: `tailscale {
+				forward_identity secret
+			}`,
+			wantName:    "caddy-proxy",
+			wantForward: "secret",
+		},
+		"forward identity missing secret": {
+			input: `tailscale {
+				forward_identity
+			}`,
+			wantErr: true,
+		},
+		"too many args": {
+			input:   `tailscale myhost extra`,
+			wantErr: true,
+		},
+		"unknown option": {
+			input: `tailscale myhost {
+				bogus
+			}`,
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			tr := new(Transport)
+			err := tr.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tr.Name != tt.wantName {
+				t.Errorf("Name = %q, want %q", tr.Name, tt.wantName)
+			}
+			if got := time.Duration(tr.DialTimeout); got != tt.wantTimeout {
+				t.Errorf("DialTimeout = %v, want %v", got, tt.wantTimeout)
+			}
+			if tr.TLSEnabled() != tt.wantTLS {
+				t.Errorf("TLSEnabled() = %v, want %v", tr.TLSEnabled(), tt.wantTLS)
+			}
+			if tr.ForwardIdentity != tt.wantForward {
+				t.Errorf("ForwardIdentity = %q, want %q", tr.ForwardIdentity, tt.wantForward)
+			}
+		})
+	}
+}
+
+func Test_TransportValidate(t *testing.T) {
+	tests := map[string]struct {
+		transport reverseproxy.HTTPTransport
+		wantErr   bool
+	}{
+		"defaults":       {},
+		"timeouts":       {transport: reverseproxy.HTTPTransport{DialTimeout: caddy.Duration(time.Second), ResponseHeaderTimeout: caddy.Duration(time.Second)}},
+		"h2c":            {transport: reverseproxy.HTTPTransport{Versions: []string{"h2c", "2"}}},
+		"local address":  {transport: reverseproxy.HTTPTransport{LocalAddress: "127.0.0.1"}, wantErr: true},
+		"proxy protocol": {transport: reverseproxy.HTTPTransport{ProxyProtocol: "v2"}, wantErr: true},
+		"read timeout":   {transport: reverseproxy.HTTPTransport{ReadTimeout: caddy.Duration(time.Second)}, wantErr: true},
+		"http3":          {transport: reverseproxy.HTTPTransport{Versions: []string{"3"}}, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			tr := &Transport{HTTPTransport: tt.transport}
+			if err := tr.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_TransportProvision(t *testing.T) {
+	must.Do(caddy.Run(new(caddy.Config)))
+	ctx := caddy.ActiveContext()
+
+	tr := &Transport{
+		Name:          "transportnode",
+		HTTPTransport: reverseproxy.HTTPTransport{Versions: []string{"1.1", "h2c"}},
+	}
+	must.Do(tr.Provision(ctx))
+	defer tr.Cleanup()
+
+	if tr.DialTimeout != 0 {
+		t.Errorf("DialTimeout = %v, want no default timeout", tr.DialTimeout)
+	}
+	if tr.Transport == nil || tr.Transport.DialContext == nil {
+		t.Fatal("transport does not dial through the node")
+	}
+	if tr.Transport.Proxy != nil {
+		t.Error("transport uses a proxy from the environment")
+	}
+	if tr.h2c == nil {
+		t.Error("h2c transport not configured")
+	}
+	if refs, ok := nodes.References("transportnode"); !ok || refs != 1 {
+		t.Errorf("node references = %d, %v, want 1", refs, ok)
+	}
+
+	// Caddy cleans up modules that fail to provision,
+	// which must not release the node reference held by the other transport.
+	failed := &Transport{
+		Name:          "transportnode",
+		HTTPTransport: reverseproxy.HTTPTransport{LocalAddress: "127.0.0.1"},
+	}
+	if err := failed.Provision(ctx); err == nil {
+		t.Fatal("Provision() with local_address succeeded, want error")
+	}
+	must.Do(failed.Cleanup())
+	if refs, ok := nodes.References("transportnode"); !ok || refs != 1 {
+		t.Errorf("node references after failed provision = %d, %v, want 1", refs, ok)
+	}
+}
+
+func Test_TransportDialsUpstream(t *testing.T) {
+	var dialed []string
+	tr := &Transport{
+		HTTPTransport: reverseproxy.HTTPTransport{Transport: new(http.Transport)},
+		dialNode: func(_ context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, network+"/"+addr)
+			return nil, errors.New("not dialing in tests")
+		},
+	}
+
+	// withDialInfo returns a context with the dial info of the upstream chosen by the reverse proxy.
+	withDialInfo := func(dialInfo reverseproxy.DialInfo) context.Context {
+		vars := map[string]any{"reverse_proxy.dial_info": dialInfo}
+		return context.WithValue(context.Background(), caddyhttp.VarsCtxKey, vars)
+	}
+
+	tr.dial(context.Background(), "tcp", "fromurl:80")
+	tr.dial(withDialInfo(reverseproxy.DialInfo{Network: "tcp", Address: "backend-2:8080"}), "tcp", "fromurl:80")
+	tr.dial(withDialInfo(reverseproxy.DialInfo{Network: "tcp6", Address: "[fd7a:115c:a1e0::1]:80"}), "tcp", "fromurl:80")
+	if _, err := tr.dial(withDialInfo(reverseproxy.DialInfo{Network: "unix", Address: "/run/app.sock"}), "tcp", "fromurl:80"); err == nil {
+		t.Error("dial() of unix upstream succeeded, want error")
+	}
+	if _, err := tr.dial(context.Background(), "tcp", "fromurl:80"); !isDialError(err) {
+		t.Errorf("dial() error = %v, want a reverseproxy.DialError", err)
+	}
+
+	want := []string{"tcp/fromurl:80", "tcp/backend-2:8080", "tcp6/[fd7a:115c:a1e0::1]:80", "tcp/fromurl:80"}
+	if !slices.Equal(dialed, want) {
+		t.Errorf("dialed = %v, want %v", dialed, want)
+	}
+
+	// a network proxy is dialed at the address given by the transport
+	dialed = nil
+	tr.Transport.Proxy = http.ProxyFromEnvironment
+	tr.dial(withDialInfo(reverseproxy.DialInfo{Network: "tcp", Address: "backend-2:8080"}), "tcp", "proxy:3128")
+	if want := []string{"tcp/proxy:3128"}; !slices.Equal(dialed, want) {
+		t.Errorf("dialed = %v, want %v", dialed, want)
+	}
+}
+
+// isDialError reports whether err is retried by the reverse proxy as a dial error.
+func isDialError(err error) bool {
+	_, ok := err.(reverseproxy.DialError)
+	return ok
+}
+
+func Test_DialError(t *testing.T) {
+	// dialError relies on DialError having the same layout as an error
+	if got, want := unsafe.Sizeof(reverseproxy.DialError{}), unsafe.Sizeof(error(nil)); got != want {
+		t.Fatalf("reverseproxy.DialError size = %d, want %d", got, want)
+	}
+	inner := errors.New("no route to host")
+	err := dialError(inner)
+	if !isDialError(err) {
+		t.Errorf("dialError() = %T, want reverseproxy.DialError", err)
+	}
+	if err.Error() != inner.Error() {
+		t.Errorf("dialError().Error() = %q, want %q", err.Error(), inner.Error())
+	}
+}
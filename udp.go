@@ -0,0 +1,536 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// udp.go contains the packet conns used by UDP listeners, which follow the Tailscale IPs of their node.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+)
+
+// errNoTailscaleIP is returned when a node has no Tailscale IP for the network of a UDP listener.
+var errNoTailscaleIP = errors.New("no suitable Tailscale IP address found for UDP listener")
+
+// rebindRetryInterval is the minimum time between attempts to watch the IPN bus of a node
+// for Tailscale IP changes.
+const rebindRetryInterval = 5 * time.Second
+
+// selectUDPAddr returns the address to listen on for the requested network ("udp", "udp4", or "udp6"),
+// along with the network to pass to tsnet.
+//
+// MagicDNS returns IPv4 addresses unless IPv4 is disabled,
+// so IPv4 is preferred unless IPv6 was explicitly requested.
+func selectUDPAddr(network string, ip4, ip6 netip.Addr, port uint16) (netip.AddrPort, string, bool) {
+	if (network == "udp" || network == "udp4") && ip4.IsValid() {
+		return netip.AddrPortFrom(ip4, port), "udp4", true
+	}
+	if (network == "udp" || network == "udp6") && ip6.IsValid() {
+		return netip.AddrPortFrom(ip6, port), "udp6", true
+	}
+	return netip.AddrPort{}, "", false
+}
+
+// maxUDPPacketSize is the size of the buffer used to read packets in a dualStackPacketConn.
+const maxUDPPacketSize = 64 * 1024
+
+// readRetryInterval is how long a dualStackPacketConn waits to read again from a packet conn after a read error.
+const readRetryInterval = 100 * time.Millisecond
+
+// nodePacketConn is a [net.PacketConn] on the Tailscale IPs of a node.
+type nodePacketConn interface {
+	net.PacketConn
+
+	// watch follows changes to the node's Tailscale IPs until the packet conn is closed.
+	watch(node *tailscaleNode, name string, logger *zap.Logger)
+}
+
+// newNodePacketConn returns a packet conn on the current Tailscale IPs for network.
+// For "udp", the packet conn listens on both the IPv4 and IPv6 address of the node,
+// if it has both, or if its addresses are not yet known.
+func newNodePacketConn(network string, port uint16, addrs func() (ip4, ip6 netip.Addr), listen func(network, addr string) (net.PacketConn, error)) (nodePacketConn, error) {
+	if ip4, ip6 := addrs(); network != "udp" || ip4.IsValid() != ip6.IsValid() {
+		pc, err := newRebindingPacketConn(network, port, addrs, listen)
+		if err != nil {
+			return nil, err
+		}
+		return pc, nil
+	}
+
+	pc4, err := newRebindingPacketConn("udp4", port, addrs, listen)
+	if err != nil {
+		return nil, err
+	}
+	pc6, err := newRebindingPacketConn("udp6", port, addrs, listen)
+	if err != nil {
+		pc4.Close()
+		return nil, err
+	}
+	return newDualStackPacketConn(pc4, pc6), nil
+}
+
+// rebindingPacketConn is a [net.PacketConn] bound to a Tailscale IP of a node.
+// When the node's Tailscale IPs change, it transparently rebinds to the new address,
+// so that the packet conn, and any QUIC sessions that remain valid on it, survive the change.
+type rebindingPacketConn struct {
+	network string // requested network: "udp", "udp4", or "udp6"
+	port    uint16
+
+	// addrs returns the current Tailscale IPs of the node.
+	addrs func() (ip4, ip6 netip.Addr)
+
+	// listen opens a packet conn on the node.
+	listen func(network, addr string) (net.PacketConn, error)
+
+	// ctx is canceled when the packet conn is closed, stopping the IPN bus watcher.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu            sync.Mutex
+	pc            net.PacketConn
+	addr          netip.AddrPort
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        bool
+}
+
+// newRebindingPacketConn returns a packet conn bound to the current Tailscale IP for network.
+// If the node has no Tailscale IP for network yet, such as before it is running,
+// the packet conn is unbound until rebind finds one.
+// Call rebind to follow changes to the Tailscale IPs.
+func newRebindingPacketConn(network string, port uint16, addrs func() (ip4, ip6 netip.Addr), listen func(network, addr string) (net.PacketConn, error)) (*rebindingPacketConn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &rebindingPacketConn{
+		network: network,
+		port:    port,
+		addrs:   addrs,
+		listen:  listen,
+		ctx:     ctx,
+		cancel:  cancel,
+		pc:      newUnboundPacketConn(port),
+	}
+	if _, err := p.rebind(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return p, nil
+}
+
+// rebind binds the packet conn to the current Tailscale IP for its network,
+// if it has changed, and reports whether it was rebound.
+// Reads that are blocked on the previous address continue on the new one.
+func (p *rebindingPacketConn) rebind() (bool, error) {
+	ip4, ip6 := p.addrs()
+	ap, network, ok := selectUDPAddr(p.network, ip4, ip6, p.port)
+
+	p.mu.Lock()
+	bound, unchanged := p.addr.IsValid(), p.addr == ap
+	p.mu.Unlock()
+	if !ok && !bound {
+		// still waiting for the node's Tailscale IPs
+		return false, nil
+	}
+	if !ok {
+		return false, errNoTailscaleIP
+	}
+	if unchanged {
+		return false, nil
+	}
+
+	pc, err := p.listen(network, ap.String())
+	if err != nil {
+		return false, err
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		pc.Close()
+		return false, net.ErrClosed
+	}
+	old := p.pc
+	p.pc, p.addr = pc, ap
+	if !p.readDeadline.IsZero() {
+		pc.SetReadDeadline(p.readDeadline)
+	}
+	if !p.writeDeadline.IsZero() {
+		pc.SetWriteDeadline(p.writeDeadline)
+	}
+	p.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return true, nil
+}
+
+// watch rebinds the packet conn whenever the node's Tailscale IPs change,
+// until the packet conn is closed.
+func (p *rebindingPacketConn) watch(node *tailscaleNode, name string, logger *zap.Logger) {
+	watchTailscaleIPs(p.ctx, node, name, logger, p.rebind)
+}
+
+// watchTailscaleIPs calls rebind whenever the node receives a new netmap, until ctx is canceled.
+// The IPN bus is watched again after rebindRetryInterval if watching fails.
+func watchTailscaleIPs(ctx context.Context, node *tailscaleNode, name string, logger *zap.Logger, rebind func() (bool, error)) {
+	for ctx.Err() == nil {
+		if err := watchTailscaleIPsOnce(ctx, node, name, logger, rebind); err != nil && ctx.Err() == nil {
+			logger.Debug("stopped watching IPN bus for Tailscale IP changes", zap.String("node", name), zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(rebindRetryInterval):
+		}
+	}
+}
+
+func watchTailscaleIPsOnce(ctx context.Context, node *tailscaleNode, name string, logger *zap.Logger, rebind func() (bool, error)) error {
+	lc, err := node.LocalClient()
+	if err != nil {
+		return err
+	}
+	// The initial netmap binds packet conns that were created before the node was running.
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return err
+		}
+		if n.NetMap == nil {
+			continue
+		}
+
+		rebound, err := rebind()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			logger.Warn("unable to rebind UDP listener to new Tailscale IP", zap.String("node", name), zap.Error(err))
+		} else if rebound {
+			logger.Info("rebound UDP listener to new Tailscale IP", zap.String("node", name))
+		}
+	}
+}
+
+// bound reports whether the packet conn is bound to a Tailscale IP.
+func (p *rebindingPacketConn) bound() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addr.IsValid()
+}
+
+// current returns the packet conn currently bound.
+func (p *rebindingPacketConn) current() net.PacketConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pc
+}
+
+func (p *rebindingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		pc := p.current()
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil && pc != p.current() {
+			// the packet conn was rebound while reading
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+func (p *rebindingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return p.current().WriteTo(b, addr)
+}
+
+func (p *rebindingPacketConn) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	p.cancel()
+	return p.pc.Close()
+}
+
+func (p *rebindingPacketConn) LocalAddr() net.Addr {
+	return p.current().LocalAddr()
+}
+
+func (p *rebindingPacketConn) SetDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readDeadline, p.writeDeadline = t, t
+	return p.pc.SetDeadline(t)
+}
+
+func (p *rebindingPacketConn) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readDeadline = t
+	return p.pc.SetReadDeadline(t)
+}
+
+func (p *rebindingPacketConn) SetWriteDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writeDeadline = t
+	return p.pc.SetWriteDeadline(t)
+}
+
+// unboundPacketConn is the packet conn of a [rebindingPacketConn] until the node has a Tailscale IP to bind to.
+// Reads block until it is closed, which happens once the packet conn is bound, and writes fail.
+type unboundPacketConn struct {
+	addr         net.Addr
+	closed       chan struct{}
+	closeOnce    sync.Once
+	readDeadline *pipeDeadline
+}
+
+func newUnboundPacketConn(port uint16) *unboundPacketConn {
+	return &unboundPacketConn{
+		addr:         net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.IPv4Unspecified(), port)),
+		closed:       make(chan struct{}),
+		readDeadline: newPipeDeadline(),
+	}
+}
+
+func (c *unboundPacketConn) ReadFrom([]byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, c.opError("read", net.ErrClosed)
+	case <-c.readDeadline.wait():
+		return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+	}
+}
+
+func (c *unboundPacketConn) WriteTo([]byte, net.Addr) (int, error) {
+	return 0, c.opError("write", errNoTailscaleIP)
+}
+
+func (c *unboundPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *unboundPacketConn) LocalAddr() net.Addr { return c.addr }
+
+func (c *unboundPacketConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *unboundPacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *unboundPacketConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *unboundPacketConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: c.addr, Err: err}
+}
+
+// dualStackPacketConn is a [net.PacketConn] that reads from both an IPv4 and an IPv6 packet conn,
+// and writes to whichever matches the family of the destination address.
+// This allows a single packet conn, such as the one used by HTTP/3, to serve clients over both families.
+type dualStackPacketConn struct {
+	pc4, pc6 *rebindingPacketConn
+
+	// packets receives the packets read from either packet conn.
+	packets chan dualStackPacket
+
+	// ctx is canceled when the packet conn is closed, stopping the readers and IPN bus watcher.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	readDeadline *pipeDeadline
+}
+
+type dualStackPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+func newDualStackPacketConn(pc4, pc6 *rebindingPacketConn) *dualStackPacketConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &dualStackPacketConn{
+		pc4:          pc4,
+		pc6:          pc6,
+		packets:      make(chan dualStackPacket),
+		ctx:          ctx,
+		cancel:       cancel,
+		readDeadline: newPipeDeadline(),
+	}
+	go p.read(pc4)
+	go p.read(pc6)
+	return p
+}
+
+// read forwards packets from pc to ReadFrom until pc or p is closed.
+// Other read errors are retried after readRetryInterval, so that a transient error on one family
+// does not stop the packet conn from receiving packets of that family.
+func (p *dualStackPacketConn) read(pc net.PacketConn) {
+	b := make([]byte, maxUDPPacketSize)
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-time.After(readRetryInterval):
+				continue
+			}
+		}
+		select {
+		case p.packets <- dualStackPacket{data: bytes.Clone(b[:n]), addr: addr}:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// rebind rebinds both packet conns to the current Tailscale IPs, if they have changed.
+func (p *dualStackPacketConn) rebind() (bool, error) {
+	rebound4, err4 := p.pc4.rebind()
+	rebound6, err6 := p.pc6.rebind()
+	return rebound4 || rebound6, errors.Join(err4, err6)
+}
+
+func (p *dualStackPacketConn) watch(node *tailscaleNode, name string, logger *zap.Logger) {
+	watchTailscaleIPs(p.ctx, node, name, logger, p.rebind)
+}
+
+func (p *dualStackPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-p.packets:
+		return copy(b, pkt.data), pkt.addr, nil
+	case <-p.ctx.Done():
+		return 0, nil, p.opError("read", net.ErrClosed)
+	case <-p.readDeadline.wait():
+		return 0, nil, p.opError("read", os.ErrDeadlineExceeded)
+	}
+}
+
+func (p *dualStackPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if p.ctx.Err() != nil {
+		return 0, p.opError("write", net.ErrClosed)
+	}
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil && ap.Addr().Unmap().Is6() {
+		return p.pc6.WriteTo(b, addr)
+	}
+	return p.pc4.WriteTo(b, addr)
+}
+
+func (p *dualStackPacketConn) Close() error {
+	p.cancel()
+	return errors.Join(p.pc4.Close(), p.pc6.Close())
+}
+
+// LocalAddr returns the IPv4 address of the packet conn,
+// or its IPv6 address if only that family is bound.
+func (p *dualStackPacketConn) LocalAddr() net.Addr {
+	if !p.pc4.bound() && p.pc6.bound() {
+		return p.pc6.LocalAddr()
+	}
+	return p.pc4.LocalAddr()
+}
+
+func (p *dualStackPacketConn) SetDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	return p.SetWriteDeadline(t)
+}
+
+func (p *dualStackPacketConn) SetReadDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	return nil
+}
+
+func (p *dualStackPacketConn) SetWriteDeadline(t time.Time) error {
+	return errors.Join(p.pc4.SetWriteDeadline(t), p.pc6.SetWriteDeadline(t))
+}
+
+func (p *dualStackPacketConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: p.LocalAddr(), Err: err}
+}
+
+// pipeDeadline is a deadline that can be waited on, similar to the one used by [net.Pipe].
+type pipeDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline is exceeded
+}
+
+func newPipeDeadline() *pipeDeadline {
+	return &pipeDeadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline. A zero time clears the deadline.
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline is exceeded.
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+var (
+	_ nodePacketConn = (*rebindingPacketConn)(nil)
+	_ nodePacketConn = (*dualStackPacketConn)(nil)
+)
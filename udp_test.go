@@ -0,0 +1,352 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/util/must"
+)
+
+func Test_SelectUDPAddr(t *testing.T) {
+	ip4 := netip.MustParseAddr("100.64.0.1")
+	ip6 := netip.MustParseAddr("fd7a:115c:a1e0::1")
+
+	tests := map[string]struct {
+		network     string
+		ip4, ip6    netip.Addr
+		want        string
+		wantNetwork string
+		wantOK      bool
+	}{
+		"udp prefers ipv4": {
+			network: "udp", ip4: ip4, ip6: ip6,
+			want: "100.64.0.1:443", wantNetwork: "udp4", wantOK: true,
+		},
+		"udp falls back to ipv6": {
+			network: "udp", ip6: ip6,
+			want: "[fd7a:115c:a1e0::1]:443", wantNetwork: "udp6", wantOK: true,
+		},
+		"udp6 requested": {
+			network: "udp6", ip4: ip4, ip6: ip6,
+			want: "[fd7a:115c:a1e0::1]:443", wantNetwork: "udp6", wantOK: true,
+		},
+		"udp4 without ipv4": {
+			network: "udp4", ip6: ip6,
+		},
+		"no addresses": {
+			network: "udp",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ap, network, ok := selectUDPAddr(tt.network, tt.ip4, tt.ip6, 443)
+			if ok != tt.wantOK {
+				t.Fatalf("selectUDPAddr() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if ap.String() != tt.want || network != tt.wantNetwork {
+				t.Errorf("selectUDPAddr() = %v, %v, want %v, %v", ap, network, tt.want, tt.wantNetwork)
+			}
+		})
+	}
+}
+
+func Test_RebindingPacketConn(t *testing.T) {
+	// Use loopback addresses in place of Tailscale IPs.
+	var mu sync.Mutex
+	ip4 := netip.MustParseAddr("127.0.0.1")
+	addrs := func() (netip.Addr, netip.Addr) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ip4, netip.Addr{}
+	}
+	listen := func(network, addr string) (net.PacketConn, error) {
+		// bind to any free port, since the port is fixed for rebinding
+		ap := netip.MustParseAddrPort(addr)
+		return net.ListenPacket(network, netip.AddrPortFrom(ap.Addr(), 0).String())
+	}
+
+	pc := must.Get(newRebindingPacketConn("udp", 0, addrs, listen))
+	defer pc.Close()
+
+	// rebinding without an IP change is a no-op
+	if rebound := must.Get(pc.rebind()); rebound {
+		t.Error("rebind() = true without IP change, want false")
+	}
+
+	type packet struct {
+		data string
+		err  error
+	}
+	packets := make(chan packet)
+	go func() {
+		b := make([]byte, 64)
+		for {
+			n, _, err := pc.ReadFrom(b)
+			packets <- packet{string(b[:n]), err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(data string) {
+		t.Helper()
+		c := must.Get(net.Dial("udp", pc.LocalAddr().String()))
+		defer c.Close()
+		must.Get(c.Write([]byte(data)))
+		select {
+		case p := <-packets:
+			if p.err != nil || p.data != data {
+				t.Fatalf("ReadFrom() = %q, %v, want %q", p.data, p.err, data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for packet")
+		}
+	}
+	send("before")
+
+	mu.Lock()
+	ip4 = netip.MustParseAddr("127.0.0.2")
+	mu.Unlock()
+	if rebound := must.Get(pc.rebind()); !rebound {
+		t.Fatal("rebind() = false after IP change, want true")
+	}
+	if got := pc.LocalAddr().(*net.UDPAddr).IP.String(); got != "127.0.0.2" {
+		t.Errorf("LocalAddr() = %v, want 127.0.0.2", got)
+	}
+
+	// the blocked read continues on the new address
+	send("after")
+
+	pc.Close()
+	select {
+	case p := <-packets:
+		if p.err == nil {
+			t.Error("ReadFrom() after Close returned no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for ReadFrom to return after Close")
+	}
+}
+
+func Test_DualStackPacketConn(t *testing.T) {
+	// Use loopback addresses in place of Tailscale IPs.
+	if c, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback not available")
+	} else {
+		c.Close()
+	}
+	addrs := func() (netip.Addr, netip.Addr) {
+		return netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")
+	}
+	listen := func(network, addr string) (net.PacketConn, error) {
+		ap := netip.MustParseAddrPort(addr)
+		return net.ListenPacket(network, netip.AddrPortFrom(ap.Addr(), 0).String())
+	}
+
+	npc := must.Get(newNodePacketConn("udp", 0, addrs, listen))
+	defer npc.Close()
+	pc, ok := npc.(*dualStackPacketConn)
+	if !ok {
+		t.Fatalf("newNodePacketConn() = %T, want *dualStackPacketConn", npc)
+	}
+
+	// echo packets back to the sender
+	go func() {
+		b := make([]byte, 64)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+
+	for _, local := range []net.PacketConn{pc.pc4, pc.pc6} {
+		t.Run(local.LocalAddr().(*net.UDPAddr).IP.String(), func(t *testing.T) {
+			c := must.Get(net.Dial("udp", local.LocalAddr().String()))
+			defer c.Close()
+			must.Get(c.Write([]byte("ping")))
+			must.Do(c.SetReadDeadline(time.Now().Add(5 * time.Second)))
+			b := make([]byte, 64)
+			n := must.Get(c.Read(b))
+			if got := string(b[:n]); got != "ping" {
+				t.Errorf("echo = %q, want %q", got, "ping")
+			}
+		})
+	}
+}
+
+func Test_DualStackPacketConnDeadline(t *testing.T) {
+	if c, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback not available")
+	} else {
+		c.Close()
+	}
+	pc4 := must.Get(newRebindingPacketConn("udp4", 0, func() (netip.Addr, netip.Addr) {
+		return netip.MustParseAddr("127.0.0.1"), netip.Addr{}
+	}, net.ListenPacket))
+	pc6 := must.Get(newRebindingPacketConn("udp6", 0, func() (netip.Addr, netip.Addr) {
+		return netip.Addr{}, netip.MustParseAddr("::1")
+	}, net.ListenPacket))
+	pc := newDualStackPacketConn(pc4, pc6)
+
+	must.Do(pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond)))
+	_, _, err := pc.ReadFrom(make([]byte, 64))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadFrom() error = %v, want deadline exceeded", err)
+	}
+
+	// clearing the deadline blocks reads until closed
+	must.Do(pc.SetReadDeadline(time.Time{}))
+	errc := make(chan error)
+	go func() {
+		_, _, err := pc.ReadFrom(make([]byte, 64))
+		errc <- err
+	}()
+	pc.Close()
+	if err := <-errc; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom() after Close error = %v, want net.ErrClosed", err)
+	}
+}
+
+// flakyPacketConn is a [net.PacketConn] whose first read fails.
+type flakyPacketConn struct {
+	net.PacketConn
+	failed atomic.Bool
+}
+
+func (c *flakyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if !c.failed.Swap(true) {
+		return 0, nil, errors.New("transient read error")
+	}
+	return c.PacketConn.ReadFrom(b)
+}
+
+func Test_DualStackPacketConnReadError(t *testing.T) {
+	inner := must.Get(net.ListenPacket("udp4", "127.0.0.1:0"))
+	defer inner.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pc := &dualStackPacketConn{
+		packets:      make(chan dualStackPacket),
+		ctx:          ctx,
+		cancel:       cancel,
+		readDeadline: newPipeDeadline(),
+	}
+	// packets are still forwarded after a read error
+	go pc.read(&flakyPacketConn{PacketConn: inner})
+
+	c := must.Get(net.Dial("udp", inner.LocalAddr().String()))
+	defer c.Close()
+	must.Get(c.Write([]byte("ping")))
+	must.Do(pc.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	b := make([]byte, 64)
+	n, _, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("ReadFrom() after read error = %v", err)
+	}
+	if got := string(b[:n]); got != "ping" {
+		t.Errorf("ReadFrom() = %q, want %q", got, "ping")
+	}
+}
+
+func Test_DualStackPacketConnLocalAddr(t *testing.T) {
+	if c, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback not available")
+	} else {
+		c.Close()
+	}
+	// a node with only an IPv6 address
+	addrs := func() (netip.Addr, netip.Addr) {
+		return netip.Addr{}, netip.MustParseAddr("::1")
+	}
+	listen := func(network, addr string) (net.PacketConn, error) {
+		ap := netip.MustParseAddrPort(addr)
+		return net.ListenPacket(network, netip.AddrPortFrom(ap.Addr(), 0).String())
+	}
+	pc4 := must.Get(newRebindingPacketConn("udp4", 0, addrs, listen))
+	pc6 := must.Get(newRebindingPacketConn("udp6", 0, addrs, listen))
+	pc := newDualStackPacketConn(pc4, pc6)
+	defer pc.Close()
+
+	if got, want := pc.LocalAddr().String(), pc6.LocalAddr().String(); got != want {
+		t.Errorf("LocalAddr() = %v, want the bound IPv6 address %v", got, want)
+	}
+}
+
+func Test_RebindingPacketConnUnbound(t *testing.T) {
+	// Use a loopback address in place of the Tailscale IP, once the node has one.
+	var mu sync.Mutex
+	var ip4 netip.Addr
+	addrs := func() (netip.Addr, netip.Addr) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ip4, netip.Addr{}
+	}
+	listen := func(network, addr string) (net.PacketConn, error) {
+		ap := netip.MustParseAddrPort(addr)
+		return net.ListenPacket(network, netip.AddrPortFrom(ap.Addr(), 0).String())
+	}
+
+	// "udp" listens on both families until the node's addresses are known
+	npc := must.Get(newNodePacketConn("udp", 0, addrs, listen))
+	if _, ok := npc.(*dualStackPacketConn); !ok {
+		t.Errorf("newNodePacketConn() without addresses = %T, want *dualStackPacketConn", npc)
+	}
+	npc.Close()
+
+	pc := must.Get(newRebindingPacketConn("udp4", 0, addrs, listen))
+	defer pc.Close()
+	if rebound := must.Get(pc.rebind()); rebound {
+		t.Error("rebind() = true without an IP, want false")
+	}
+	if _, err := pc.WriteTo([]byte("x"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}); err == nil {
+		t.Error("WriteTo() on unbound packet conn succeeded, want error")
+	}
+
+	type packet struct {
+		data string
+		err  error
+	}
+	packets := make(chan packet, 1)
+	go func() {
+		b := make([]byte, 64)
+		n, _, err := pc.ReadFrom(b)
+		packets <- packet{string(b[:n]), err}
+	}()
+
+	mu.Lock()
+	ip4 = netip.MustParseAddr("127.0.0.1")
+	mu.Unlock()
+	if rebound := must.Get(pc.rebind()); !rebound {
+		t.Fatal("rebind() = false once the node has an IP, want true")
+	}
+
+	// the read blocked before the packet conn was bound continues on the new address
+	c := must.Get(net.Dial("udp", pc.LocalAddr().String()))
+	defer c.Close()
+	must.Get(c.Write([]byte("bound")))
+	select {
+	case p := <-packets:
+		if p.err != nil || p.data != "bound" {
+			t.Fatalf("ReadFrom() = %q, %v, want %q", p.data, p.err, "bound")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for packet")
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// upstreams.go contains the Upstreams module, which discovers reverse proxy upstreams on the tailnet.
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+func init() {
+	caddy.RegisterModule(&Upstreams{})
+}
+
+// Upstreams provides reverse proxy upstreams from the online peers in the netmap of a tailscale node.
+// The upstreams are refreshed whenever the node receives a new netmap.
+//
+// Each field matches a peer if any of its values match. All configured fields must match.
+// Upstreams are dialed at the peer's Tailscale IP address, so they are usually used with the tailscale transport.
+type Upstreams struct {
+	// Name is the name of the node whose netmap is used. Default: caddy-proxy
+	Name string `json:"name,omitempty"`
+
+	// Tags matches any of the ACL tags of the peer, such as "tag:api".
+	Tags []string `json:"tag,omitempty"`
+
+	// Hostnames matches the short MagicDNS name or the hostname of the peer
+	// against glob patterns, such as "api-*".
+	Hostnames []string `json:"hostname,omitempty"`
+
+	// OS matches the operating system of the peer, such as "linux".
+	OS []string `json:"os,omitempty"`
+
+	// Port is the port of the upstreams. Default: 80
+	Port string `json:"port,omitempty"`
+
+	node   *tailscaleNode
+	logger *zap.Logger
+
+	// upstreams are the upstreams from the latest netmap, or nil if they have not been loaded yet.
+	upstreams atomic.Pointer[[]*reverseproxy.Upstream]
+
+	watchOnce sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+func (u *Upstreams) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.upstreams.tailscale",
+		New: func() caddy.Module { return new(Upstreams) },
+	}
+}
+
+// UnmarshalCaddyfile populates an Upstreams config from a caddyfile.
+//
+// The upstreams take an optional token identifying the name of a node in the App config,
+// and a block of fields to match peers by. For example:
+//
+//	reverse_proxy {
+//	  dynamic tailscale my-node {
+//	    tag tag:api
+//	    hostname api-*
+//	    os linux
+//	    port 8080
+//	  }
+//	  transport tailscale my-node
+//	}
+//
+// If a node name is not specified, a default name is used.
+func (u *Upstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	const defaultNodeName = "caddy-proxy"
+
+	d.Next() // skip upstream source name
+	if d.NextArg() {
+		u.Name = d.Val()
+	} else {
+		u.Name = defaultNodeName
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "tag":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			u.Tags = append(u.Tags, args...)
+		case "hostname":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			u.Hostnames = append(u.Hostnames, args...)
+		case "os":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			u.OS = append(u.OS, args...)
+		case "port":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if u.Port != "" {
+				return d.Err("a port has already been specified")
+			}
+			u.Port = d.Val()
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+func (u *Upstreams) Provision(ctx caddy.Context) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+	if u.Port == "" {
+		u.Port = "80"
+	}
+
+	var err error
+	u.node, err = getNode(ctx, u.Name)
+	if err != nil {
+		return err
+	}
+	u.logger = ctx.Logger()
+	u.ctx, u.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+// validate returns an error if the hostname patterns or port are malformed.
+func (u *Upstreams) validate() error {
+	for _, pattern := range u.Hostnames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid hostname pattern %q: %w", pattern, err)
+		}
+	}
+	if u.Port != "" {
+		if _, err := strconv.ParseUint(u.Port, 10, 16); err != nil {
+			return fmt.Errorf("invalid port %q: %w", u.Port, err)
+		}
+	}
+	return nil
+}
+
+// GetUpstreams returns an upstream for each online peer that matches the configured fields.
+// The peers are looked up on the first request, after which they are refreshed on netmap changes.
+func (u *Upstreams) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	if ups := u.upstreams.Load(); ups != nil {
+		return *ups, nil
+	}
+
+	// Load the upstreams for this request, so that it does not wait for the watcher to start.
+	if err := u.refresh(r.Context()); err != nil {
+		return nil, err
+	}
+	u.watchOnce.Do(func() { go u.watch() })
+	return *u.upstreams.Load(), nil
+}
+
+// refresh loads the upstreams from the status of the node.
+func (u *Upstreams) refresh(ctx context.Context) error {
+	lc, err := u.node.LocalClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	st, err := lc.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("getting status of tailscale node %s: %w", u.Name, err)
+	}
+
+	ups := u.upstreamsFromStatus(st)
+	if old := u.upstreams.Swap(&ups); old == nil || !slices.EqualFunc(*old, ups, func(a, b *reverseproxy.Upstream) bool {
+		return a.Dial == b.Dial
+	}) {
+		dials := make([]string, 0, len(ups))
+		for _, up := range ups {
+			dials = append(dials, up.Dial)
+		}
+		u.logger.Debug("tailscale upstreams updated", zap.String("node", u.Name), zap.Strings("upstreams", dials))
+	}
+	return nil
+}
+
+// upstreamsFromStatus returns an upstream for each online peer in st that matches the configured fields,
+// sorted by the peers' MagicDNS names.
+func (u *Upstreams) upstreamsFromStatus(st *ipnstate.Status) []*reverseproxy.Upstream {
+	var peers []*ipnstate.PeerStatus
+	for _, peer := range st.Peer {
+		if peer.Online && len(peer.TailscaleIPs) > 0 && u.matchPeer(peer) {
+			peers = append(peers, peer)
+		}
+	}
+	slices.SortFunc(peers, func(a, b *ipnstate.PeerStatus) int {
+		return cmp.Compare(a.DNSName, b.DNSName)
+	})
+
+	ups := make([]*reverseproxy.Upstream, 0, len(peers))
+	for _, peer := range peers {
+		// prefer the IPv4 address, which is listed first
+		ip := peer.TailscaleIPs[0]
+		ups = append(ups, &reverseproxy.Upstream{Dial: net.JoinHostPort(ip.String(), u.Port)})
+	}
+	return ups
+}
+
+// matchPeer reports whether peer matches all configured fields.
+func (u *Upstreams) matchPeer(peer *ipnstate.PeerStatus) bool {
+	if len(u.Tags) > 0 {
+		var tags []string
+		if peer.Tags != nil {
+			tags = peer.Tags.AsSlice()
+		}
+		if !slices.ContainsFunc(u.Tags, func(t string) bool { return slices.Contains(tags, t) }) {
+			return false
+		}
+	}
+
+	if len(u.Hostnames) > 0 {
+		dnsName, _, _ := strings.Cut(peer.DNSName, ".")
+		names := []string{strings.ToLower(dnsName), strings.ToLower(peer.HostName)}
+		if !slices.ContainsFunc(u.Hostnames, func(pattern string) bool {
+			return slices.ContainsFunc(names, func(name string) bool {
+				ok, _ := path.Match(strings.ToLower(pattern), name)
+				return ok && name != ""
+			})
+		}) {
+			return false
+		}
+	}
+
+	if len(u.OS) > 0 && !slices.ContainsFunc(u.OS, func(os string) bool { return strings.EqualFold(os, peer.OS) }) {
+		return false
+	}
+
+	return true
+}
+
+// watch refreshes the upstreams whenever the node receives a new netmap, until u is cleaned up.
+func (u *Upstreams) watch() {
+	for u.ctx.Err() == nil {
+		if err := u.watchIPNBus(); err != nil && u.ctx.Err() == nil {
+			u.logger.Debug("stopped watching IPN bus for tailscale upstream changes",
+				zap.String("node", u.Name), zap.Error(err))
+		}
+
+		select {
+		case <-u.ctx.Done():
+		case <-time.After(ipnBusRetryInterval):
+		}
+	}
+}
+
+func (u *Upstreams) watchIPNBus() error {
+	lc, err := u.node.LocalClient()
+	if err != nil {
+		return err
+	}
+	watcher, err := lc.WatchIPNBus(u.ctx, ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return err
+		}
+		if n.NetMap == nil {
+			continue
+		}
+		if err := u.refresh(u.ctx); err != nil {
+			u.logger.Warn("unable to refresh tailscale upstreams", zap.String("node", u.Name), zap.Error(err))
+		}
+	}
+}
+
+func (u *Upstreams) Cleanup() error {
+	if u.cancel != nil {
+		u.cancel()
+	}
+	return releaseNode(u.Name, u.node)
+}
+
+var (
+	_ reverseproxy.UpstreamSource = (*Upstreams)(nil)
+	_ caddy.Provisioner           = (*Upstreams)(nil)
+	_ caddy.CleanerUpper          = (*Upstreams)(nil)
+	_ caddyfile.Unmarshaler       = (*Upstreams)(nil)
+)
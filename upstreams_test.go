@@ -0,0 +1,201 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+	"tailscale.com/types/views"
+	"tailscale.com/util/must"
+)
+
+func Test_UpstreamsUnmarshalCaddyfile(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    *Upstreams
+		wantErr bool
+	}{
+		"default node": {
+			input: `tailscale`,
+			want:  &Upstreams{Name: "caddy-proxy"},
+		},
+		"named node with fields": {
+			input: `tailscale myhost {
+				tag tag:api tag:web
+				hostname api-*
+				os linux
+				port 8080
+			}`,
+			want: &Upstreams{
+				Name:      "myhost",
+				Tags:      []string{"tag:api", "tag:web"},
+				Hostnames: []string{"api-*"},
+				OS:        []string{"linux"},
+				Port:      "8080",
+			},
+		},
+		"too many args": {
+			input:   `tailscale myhost extra`,
+			wantErr: true,
+		},
+		"missing value": {
+			input: `tailscale {
+				tag
+			}`,
+			wantErr: true,
+		},
+		"duplicate port": {
+			input: `tailscale {
+				port 80
+				port 8080
+			}`,
+			wantErr: true,
+		},
+		"unknown field": {
+			input: `tailscale {
+				bogus
+			}`,
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got Upstreams
+			err := got.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(&got, tt.want, cmpopts.IgnoreUnexported(Upstreams{})); diff != "" {
+				t.Errorf("UnmarshalCaddyfile() diff(-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_UpstreamsValidate(t *testing.T) {
+	tests := map[string]struct {
+		upstreams *Upstreams
+		wantErr   bool
+	}{
+		"empty":           {upstreams: &Upstreams{}},
+		"valid":           {upstreams: &Upstreams{Hostnames: []string{"api-*"}, Port: "8080"}},
+		"bad pattern":     {upstreams: &Upstreams{Hostnames: []string{"api-["}}, wantErr: true},
+		"bad port":        {upstreams: &Upstreams{Port: "http"}, wantErr: true},
+		"port over range": {upstreams: &Upstreams{Port: "65536"}, wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := tt.upstreams.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_UpstreamsFromStatus(t *testing.T) {
+	peer := func(dnsName, hostName, os string, online bool, tags ...string) *ipnstate.PeerStatus {
+		ps := &ipnstate.PeerStatus{
+			DNSName:  dnsName,
+			HostName: hostName,
+			OS:       os,
+			Online:   online,
+		}
+		if len(tags) > 0 {
+			v := views.SliceOf(tags)
+			ps.Tags = &v
+		}
+		return ps
+	}
+	api1 := peer("api-1.example.ts.net.", "api-1", "linux", true, "tag:api")
+	api1.TailscaleIPs = []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")}
+	api2 := peer("api-2.example.ts.net.", "host2", "windows", true, "tag:api", "tag:web")
+	api2.TailscaleIPs = []netip.Addr{netip.MustParseAddr("100.64.0.2")}
+	offline := peer("api-3.example.ts.net.", "api-3", "linux", false, "tag:api")
+	offline.TailscaleIPs = []netip.Addr{netip.MustParseAddr("100.64.0.3")}
+	laptop := peer("laptop.example.ts.net.", "Laptop", "macOS", true)
+	laptop.TailscaleIPs = []netip.Addr{netip.MustParseAddr("100.64.0.4")}
+
+	st := &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+		key.NewNode().Public(): api2,
+		key.NewNode().Public(): laptop,
+		key.NewNode().Public(): offline,
+		key.NewNode().Public(): api1,
+	}}
+
+	tests := map[string]struct {
+		upstreams *Upstreams
+		want      []string
+	}{
+		"all online": {
+			upstreams: &Upstreams{Port: "80"},
+			want:      []string{"100.64.0.1:80", "100.64.0.2:80", "100.64.0.4:80"},
+		},
+		"tag": {
+			upstreams: &Upstreams{Tags: []string{"tag:web", "tag:db"}, Port: "8080"},
+			want:      []string{"100.64.0.2:8080"},
+		},
+		"hostname glob matches MagicDNS name": {
+			upstreams: &Upstreams{Hostnames: []string{"api-*"}, Port: "80"},
+			want:      []string{"100.64.0.1:80", "100.64.0.2:80"},
+		},
+		"hostname glob matches hostname": {
+			upstreams: &Upstreams{Hostnames: []string{"HOST*"}, Port: "80"},
+			want:      []string{"100.64.0.2:80"},
+		},
+		"os": {
+			upstreams: &Upstreams{OS: []string{"Linux", "macos"}, Port: "80"},
+			want:      []string{"100.64.0.1:80", "100.64.0.4:80"},
+		},
+		"all fields must match": {
+			upstreams: &Upstreams{Tags: []string{"tag:api"}, OS: []string{"linux"}, Port: "80"},
+			want:      []string{"100.64.0.1:80"},
+		},
+		"no match": {
+			upstreams: &Upstreams{Tags: []string{"tag:db"}, Port: "80"},
+			want:      nil,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			for _, up := range tt.upstreams.upstreamsFromStatus(st) {
+				got = append(got, up.Dial)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("upstreamsFromStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_UpstreamsCleanupUnprovisioned(t *testing.T) {
+	must.Do(caddy.Run(new(caddy.Config)))
+	ctx := caddy.ActiveContext()
+
+	u := &Upstreams{Name: "upstreamsnode"}
+	must.Do(u.Provision(ctx))
+	defer u.Cleanup()
+
+	// Caddy cleans up modules that fail to provision,
+	// which must not release the node reference held by the other upstreams.
+	failed := &Upstreams{Name: "upstreamsnode", Port: "http"}
+	if err := failed.Provision(ctx); err == nil {
+		t.Fatal("Provision() with invalid port succeeded, want error")
+	}
+	must.Do(failed.Cleanup())
+	if refs, ok := nodes.References("upstreamsnode"); !ok || refs != 1 {
+		t.Errorf("node references after failed provision = %d, %v, want 1", refs, ok)
+	}
+}
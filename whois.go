@@ -0,0 +1,242 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+// whois.go contains a cache of WhoIs responses used by the TailscaleAuth module.
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// whoIsRetryInterval is the minimum time between attempts to watch the IPN bus of a LocalClient.
+// Responses from a LocalClient are not cached while its IPN bus is not being watched.
+const whoIsRetryInterval = 5 * time.Second
+
+// whoIsMinSweep is the minimum number of cached entries before expired entries are swept.
+const whoIsMinSweep = 1024
+
+// whoIsCache caches WhoIs responses by LocalClient and remote address.
+//
+// Cached responses expire after ttl, and all responses from a LocalClient are
+// invalidated when that client's node receives a new netmap over the IPN bus.
+type whoIsCache struct {
+	ttl    time.Duration
+	logger *zap.Logger
+
+	// ctx is canceled when the cache is closed, stopping all IPN bus watchers.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+
+	mu        sync.Mutex
+	entries   map[whoIsKey]whoIsEntry
+	watchers  map[*local.Client]*whoIsWatcher
+	nextSweep int
+}
+
+type whoIsKey struct {
+	client     *local.Client
+	remoteAddr string
+}
+
+type whoIsEntry struct {
+	info    *apitype.WhoIsResponse
+	expires time.Time
+}
+
+// whoIsWatcher tracks the IPN bus watcher for a single LocalClient.
+// It is removed from the cache when the watch stops, such as when the client's node is closed.
+type whoIsWatcher struct {
+	// starting is true while the IPN bus watch is being started, outside of the cache lock.
+	starting bool
+
+	// running is true while the IPN bus is being watched,
+	// and responses from the client can be cached.
+	running bool
+
+	// retryAt is the earliest time a failed watcher can be restarted.
+	retryAt time.Time
+
+	// gen is incremented each time the cached responses from the client are invalidated.
+	gen uint64
+}
+
+func newWhoIsCache(ttl time.Duration, logger *zap.Logger) *whoIsCache {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &whoIsCache{
+		ttl:       ttl,
+		logger:    logger,
+		ctx:       ctx,
+		cancel:    cancel,
+		entries:   make(map[whoIsKey]whoIsEntry),
+		watchers:  make(map[*local.Client]*whoIsWatcher),
+		nextSweep: whoIsMinSweep,
+	}
+}
+
+// WhoIs returns the cached WhoIs response for remoteAddr from client,
+// or looks it up and caches it if there is no unexpired response.
+// Errors are never cached.
+func (c *whoIsCache) WhoIs(ctx context.Context, client *local.Client, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	key := whoIsKey{client, remoteAddr}
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	w, start := c.watcherLocked(client, now)
+	c.mu.Unlock()
+
+	if ok && now.Before(entry.expires) {
+		c.hits.Add(1)
+		whoIsCacheLookups.WithLabelValues("hit").Inc()
+		return entry.info, nil
+	}
+	c.misses.Add(1)
+	whoIsCacheLookups.WithLabelValues("miss").Inc()
+
+	// The watch is started without holding c.mu,
+	// so that lookups from other clients do not wait for this client's LocalAPI.
+	if start {
+		c.startWatch(client, w)
+	}
+	c.mu.Lock()
+	cacheable, gen := w.running, w.gen
+	c.mu.Unlock()
+
+	info, err := timedWhoIs(ctx, client, remoteAddr)
+	if err != nil || !cacheable {
+		return info, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// only cache the response if it was not invalidated in the meantime,
+	// in which case it may already be stale.
+	if w.running && w.gen == gen {
+		c.entries[key] = whoIsEntry{info: info, expires: now.Add(c.ttl)}
+		c.sweepLocked(now)
+	}
+	return info, nil
+}
+
+// watcherLocked returns the watcher state for client,
+// and whether the caller should start watching the IPN bus of client with [whoIsCache.startWatch].
+// c.mu must be held.
+func (c *whoIsCache) watcherLocked(client *local.Client, now time.Time) (w *whoIsWatcher, start bool) {
+	w, ok := c.watchers[client]
+	if !ok {
+		// Drop the watchers whose start failed long enough ago to be retried,
+		// such as those of nodes closed on a config reload.
+		for cl, old := range c.watchers {
+			if !old.starting && !old.running && !now.Before(old.retryAt) {
+				delete(c.watchers, cl)
+			}
+		}
+		w = new(whoIsWatcher)
+		c.watchers[client] = w
+	}
+	if w.starting || w.running || now.Before(w.retryAt) || c.ctx.Err() != nil {
+		return w, false
+	}
+	w.starting = true
+	return w, true
+}
+
+// startWatch watches the IPN bus of client with the watcher state w, which must be marked as starting.
+// c.mu must not be held.
+func (c *whoIsCache) startWatch(client *local.Client, w *whoIsWatcher) {
+	// The watch lasts until the cache is closed, but it must start within the retry interval.
+	ctx, cancel := context.WithCancel(c.ctx)
+	timer := time.AfterFunc(whoIsRetryInterval, cancel)
+	watcher, err := client.WatchIPNBus(ctx, 0)
+	timer.Stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.starting = false
+	if err != nil {
+		cancel()
+		c.logger.Debug("unable to watch IPN bus, not caching WhoIs responses", zap.Error(err))
+		w.retryAt = time.Now().Add(whoIsRetryInterval)
+		return
+	}
+	w.running = true
+	go c.watch(client, w, watcher, cancel)
+}
+
+// watch invalidates cached responses from client whenever its node receives a new netmap.
+// When the watch stops, the watcher state w is removed from the cache.
+func (c *whoIsCache) watch(client *local.Client, w *whoIsWatcher, watcher *local.IPNBusWatcher, cancel context.CancelFunc) {
+	defer cancel()
+	defer watcher.Close()
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			if c.ctx.Err() == nil {
+				c.logger.Debug("stopped watching IPN bus, not caching WhoIs responses", zap.Error(err))
+			}
+			c.mu.Lock()
+			w.running = false
+			c.flushLocked(client, w)
+			if c.watchers[client] == w {
+				delete(c.watchers, client)
+			}
+			c.mu.Unlock()
+			return
+		}
+		if n.NetMap != nil {
+			c.mu.Lock()
+			c.flushLocked(client, w)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// flushLocked removes all cached responses from client.
+// c.mu must be held.
+func (c *whoIsCache) flushLocked(client *local.Client, w *whoIsWatcher) {
+	w.gen++
+	for key := range c.entries {
+		if key.client == client {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// sweepLocked removes expired entries once the cache has grown past nextSweep.
+// c.mu must be held.
+func (c *whoIsCache) sweepLocked(now time.Time) {
+	if len(c.entries) < c.nextSweep {
+		return
+	}
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.nextSweep = max(2*len(c.entries), whoIsMinSweep)
+}
+
+// stats returns the number of cache hits and misses.
+func (c *whoIsCache) stats() (hits, misses uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// Close stops all IPN bus watchers and removes all cached responses.
+func (c *whoIsCache) Close() {
+	c.cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	clear(c.watchers)
+}
@@ -0,0 +1,342 @@
+// Copyright (c) Tailscale Inc & contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package tscaddy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// fakeLocalAPI is a minimal LocalAPI server that answers WhoIs requests
+// and streams IPN bus notifications.
+type fakeLocalAPI struct {
+	// peers maps remote addresses to their identity.
+	peers map[string]*apitype.WhoIsResponse
+
+	// noWatch causes IPN bus watch requests to fail.
+	noWatch bool
+
+	// holdWatch, if set, delays IPN bus watch responses until it is closed.
+	holdWatch chan struct{}
+
+	// stopWatch ends IPN bus watch responses when it is closed.
+	stopWatch chan struct{}
+
+	whoIsCalls atomic.Int64
+	notify     chan ipn.Notify
+}
+
+func newFakeLocalAPI(t testing.TB, peers map[string]*apitype.WhoIsResponse) (*fakeLocalAPI, *local.Client) {
+	f := &fakeLocalAPI{
+		peers:     peers,
+		notify:    make(chan ipn.Notify),
+		stopWatch: make(chan struct{}),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	client := &local.Client{
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", srv.Listener.Addr().String())
+		},
+		OmitAuth: true,
+	}
+	return f, client
+}
+
+func (f *fakeLocalAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/localapi/v0/whois":
+		f.whoIsCalls.Add(1)
+		info, ok := f.peers[r.URL.Query().Get("addr")]
+		if !ok {
+			http.Error(w, "no match for IP:port", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(info)
+	case "/localapi/v0/watch-ipn-bus":
+		if f.noWatch {
+			http.Error(w, "not supported", http.StatusInternalServerError)
+			return
+		}
+		if f.holdWatch != nil {
+			select {
+			case <-f.holdWatch:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case n := <-f.notify:
+				enc.Encode(n)
+				w.(http.Flusher).Flush()
+			case <-f.stopWatch:
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testWhoIsPeers() map[string]*apitype.WhoIsResponse {
+	return map[string]*apitype.WhoIsResponse{
+		"100.64.0.2:1234": {
+			Node: &tailcfg.Node{
+				Name:         "laptop.example.ts.net.",
+				ComputedName: "laptop",
+				Hostinfo:     (&tailcfg.Hostinfo{}).View(),
+			},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		},
+	}
+}
+
+func Test_WhoIsCache(t *testing.T) {
+	ctx := context.Background()
+	const addr = "100.64.0.2:1234"
+
+	t.Run("hit", func(t *testing.T) {
+		f, client := newFakeLocalAPI(t, testWhoIsPeers())
+		c := newWhoIsCache(time.Minute, zap.NewNop())
+		defer c.Close()
+
+		for range 3 {
+			info, err := c.WhoIs(ctx, client, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.UserProfile.LoginName != "alice@example.com" {
+				t.Fatalf("WhoIs() login = %q, want alice@example.com", info.UserProfile.LoginName)
+			}
+		}
+		if got := f.whoIsCalls.Load(); got != 1 {
+			t.Errorf("LocalAPI WhoIs calls = %d, want 1", got)
+		}
+		if hits, misses := c.stats(); hits != 2 || misses != 1 {
+			t.Errorf("stats() = %d hits, %d misses; want 2 hits, 1 miss", hits, misses)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		f, client := newFakeLocalAPI(t, testWhoIsPeers())
+		c := newWhoIsCache(time.Millisecond, zap.NewNop())
+		defer c.Close()
+
+		for range 2 {
+			if _, err := c.WhoIs(ctx, client, addr); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+		if got := f.whoIsCalls.Load(); got != 2 {
+			t.Errorf("LocalAPI WhoIs calls = %d, want 2", got)
+		}
+	})
+
+	t.Run("netmap invalidation", func(t *testing.T) {
+		f, client := newFakeLocalAPI(t, testWhoIsPeers())
+		c := newWhoIsCache(time.Minute, zap.NewNop())
+		defer c.Close()
+
+		if _, err := c.WhoIs(ctx, client, addr); err != nil {
+			t.Fatal(err)
+		}
+
+		// the watcher has received the notification once the send completes,
+		// so wait for the cache to be flushed.
+		f.notify <- ipn.Notify{NetMap: new(netmap.NetworkMap)}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			c.mu.Lock()
+			n := len(c.entries)
+			c.mu.Unlock()
+			if n == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("cache was not invalidated by netmap notification")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		if _, err := c.WhoIs(ctx, client, addr); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.whoIsCalls.Load(); got != 2 {
+			t.Errorf("LocalAPI WhoIs calls = %d, want 2", got)
+		}
+	})
+
+	t.Run("no watcher", func(t *testing.T) {
+		f, client := newFakeLocalAPI(t, testWhoIsPeers())
+		f.noWatch = true
+		c := newWhoIsCache(time.Minute, zap.NewNop())
+		defer c.Close()
+
+		for range 2 {
+			if _, err := c.WhoIs(ctx, client, addr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := f.whoIsCalls.Load(); got != 2 {
+			t.Errorf("LocalAPI WhoIs calls = %d, want 2", got)
+		}
+	})
+
+	t.Run("stopped watcher removed", func(t *testing.T) {
+		f, client := newFakeLocalAPI(t, testWhoIsPeers())
+		c := newWhoIsCache(time.Minute, zap.NewNop())
+		defer c.Close()
+
+		if _, err := c.WhoIs(ctx, client, addr); err != nil {
+			t.Fatal(err)
+		}
+		// as when the client's node is closed
+		close(f.stopWatch)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			c.mu.Lock()
+			n, w := len(c.entries), len(c.watchers)
+			c.mu.Unlock()
+			if n == 0 && w == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("cache has %d entries and %d watchers after the watch stopped, want none", n, w)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("slow watch does not block other clients", func(t *testing.T) {
+		slow, slowClient := newFakeLocalAPI(t, testWhoIsPeers())
+		slow.holdWatch = make(chan struct{})
+		_, client := newFakeLocalAPI(t, testWhoIsPeers())
+		c := newWhoIsCache(time.Minute, zap.NewNop())
+		defer c.Close()
+
+		slowDone := make(chan error, 1)
+		go func() {
+			_, err := c.WhoIs(ctx, slowClient, addr)
+			slowDone <- err
+		}()
+		// wait for the slow watch to be starting
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			c.mu.Lock()
+			w := c.watchers[slowClient]
+			starting := w != nil && w.starting
+			c.mu.Unlock()
+			if starting {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("slow watch did not start")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := c.WhoIs(ctx, client, addr)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("WhoIs() waited for the watch of another client")
+		}
+
+		close(slow.holdWatch)
+		if err := <-slowDone; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("errors not cached", func(t *testing.T) {
+		f, client := newFakeLocalAPI(t, testWhoIsPeers())
+		c := newWhoIsCache(time.Minute, zap.NewNop())
+		defer c.Close()
+
+		for range 2 {
+			if _, err := c.WhoIs(ctx, client, "100.64.0.3:1234"); !errors.Is(err, local.ErrPeerNotFound) {
+				t.Fatalf("WhoIs() error = %v, want ErrPeerNotFound", err)
+			}
+		}
+		if got := f.whoIsCalls.Load(); got != 2 {
+			t.Errorf("LocalAPI WhoIs calls = %d, want 2", got)
+		}
+	})
+}
+
+func Test_AuthenticateCached(t *testing.T) {
+	f, client := newFakeLocalAPI(t, testWhoIsPeers())
+	ta := &Auth{cache: newWhoIsCache(time.Minute, zap.NewNop())}
+	defer ta.cache.Close()
+
+	for range 2 {
+		ctx := context.WithValue(context.Background(), localClientCtxKey{}, client)
+		r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		r.RemoteAddr = "100.64.0.2:1234"
+
+		user, ok, err := ta.Authenticate(httptest.NewRecorder(), r)
+		if err != nil || !ok {
+			t.Fatalf("Authenticate() = %v, %v", ok, err)
+		}
+		if user.ID != "alice@example.com" {
+			t.Errorf("Authenticate() ID = %q, want alice@example.com", user.ID)
+		}
+	}
+	if got := f.whoIsCalls.Load(); got != 1 {
+		t.Errorf("LocalAPI WhoIs calls = %d, want 1", got)
+	}
+}
+
+func BenchmarkAuthenticate(b *testing.B) {
+	_, client := newFakeLocalAPI(b, testWhoIsPeers())
+	ctx := context.WithValue(context.Background(), localClientCtxKey{}, client)
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	r.RemoteAddr = "100.64.0.2:1234"
+
+	for name, ttl := range map[string]time.Duration{"uncached": 0, "cached": time.Minute} {
+		b.Run(name, func(b *testing.B) {
+			ta := new(Auth)
+			if ttl > 0 {
+				ta.cache = newWhoIsCache(ttl, zap.NewNop())
+				defer ta.cache.Close()
+			}
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, _, err := ta.Authenticate(nil, r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}